@@ -0,0 +1,294 @@
+// Package metrics implements counters, gauges and histograms,
+// which are exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The default buckets of histograms, in seconds
+var DefBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type _Metric interface {
+	desc() *_Desc
+	// fn is called for each sample, labels is empty or in the form `{name="value"}`
+	samples(fn func(suffix string, labels string, value float64))
+}
+
+type _Desc struct {
+	name string
+	help string
+	typ string
+}
+
+func (d *_Desc) desc() *_Desc {
+	return d
+}
+
+// Counter is a monotonically increasing integer
+type Counter struct {
+	_Desc
+	v atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+func (c *Counter) samples(fn func(string, string, float64)) {
+	fn("", "", float64(c.v.Load()))
+}
+
+// CounterVec is a set of counters distinguished by the value of one label
+type CounterVec struct {
+	_Desc
+	label string
+	mutex sync.Mutex
+	counters map[string]*Counter
+}
+
+// Return the counter of the label value, which is created if not exist
+func (cv *CounterVec) With(value string) *Counter {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	c, ok := cv.counters[value]
+	if !ok {
+		c = &Counter{}
+		cv.counters[value] = c
+	}
+	return c
+}
+
+func (cv *CounterVec) samples(fn func(string, string, float64)) {
+	cv.mutex.Lock()
+	values := make([]string, 0, len(cv.counters))
+	counters := make(map[string]*Counter, len(cv.counters))
+	for v, c := range cv.counters {
+		values = append(values, v)
+		counters[v] = c
+	}
+	cv.mutex.Unlock()
+
+	sort.Strings(values)
+	for _, v := range values {
+		labels := fmt.Sprintf("{%s=%s}", cv.label, quoteLabel(v))
+		fn("", labels, float64(counters[v].Value()))
+	}
+}
+
+// Gauge is an integer that can go up and down
+type Gauge struct {
+	_Desc
+	v atomic.Int64
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+func (g *Gauge) samples(fn func(string, string, float64)) {
+	fn("", "", float64(g.v.Load()))
+}
+
+// The value of GaugeFunc is got by calling the function when exposed
+type GaugeFunc struct {
+	_Desc
+	fn func() float64
+}
+
+func (g *GaugeFunc) samples(fn func(string, string, float64)) {
+	fn("", "", g.fn())
+}
+
+// Histogram counts the observed values in buckets
+type Histogram struct {
+	_Desc
+	buckets []float64	// upper bounds, sorted
+	counts []atomic.Uint64	// the last one is for +Inf
+	count atomic.Uint64
+	sumBits atomic.Uint64	// math.Float64bits() of the sum
+}
+
+func (h *Histogram) Observe(v float64) {
+	k := sort.SearchFloat64s(h.buckets, v)
+	h.counts[k].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if h.sumBits.CompareAndSwap(old, sum) {
+			break
+		}
+	}
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sumBits.Load())
+}
+
+func (h *Histogram) samples(fn func(string, string, float64)) {
+	var cumulative uint64
+	for k, le := range h.buckets {
+		cumulative += h.counts[k].Load()
+		fn("_bucket", fmt.Sprintf("{le=\"%s\"}", formatValue(le)), float64(cumulative))
+	}
+	cumulative += h.counts[len(h.buckets)].Load()
+	fn("_bucket", `{le="+Inf"}`, float64(cumulative))
+	fn("_sum", "", h.Sum())
+	fn("_count", "", float64(cumulative))
+}
+
+// Registry is a set of metrics with different names
+type Registry struct {
+	mutex sync.Mutex
+	metrics []_Metric
+	names map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names:make(map[string]bool)}
+}
+
+func (r *Registry) register(m _Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name := m.desc().name
+	if r.names[name] {
+		panic("metrics: duplicate metric name " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{_Desc:_Desc{name, help, "counter"}}
+	r.register(c)
+	return c
+}
+
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	cv := &CounterVec{_Desc:_Desc{name, help, "counter"}, label:label, counters:make(map[string]*Counter)}
+	r.register(cv)
+	return cv
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{_Desc:_Desc{name, help, "gauge"}}
+	r.register(g)
+	return g
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{_Desc:_Desc{name, help, "gauge"}, fn:fn}
+	r.register(g)
+	return g
+}
+
+// If buckets is nil, DefBuckets is used
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{_Desc:_Desc{name, help, "histogram"}, buckets:buckets}
+	h.counts = make([]atomic.Uint64, len(buckets) + 1)
+	r.register(h)
+	return h
+}
+
+func (r *Registry) all() []_Metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]_Metric(nil), r.metrics...)
+}
+
+// Write all the metrics in the Prometheus text format (version 0.0.4)
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.all() {
+		d := m.desc()
+		if d.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", d.name, d.typ)
+		m.samples(func(suffix, labels string, value float64) {
+			fmt.Fprintf(bw, "%s%s%s %s\n", d.name, suffix, labels, formatValue(value))
+		})
+	}
+	return bw.Flush()
+}
+
+// Return all the samples, the keys are the sample names with labels,
+// e.g. `xic_quests_total` and `xic_exceptions_total{name="X"}`
+func (r *Registry) Values() map[string]float64 {
+	values := make(map[string]float64)
+	for _, m := range r.all() {
+		name := m.desc().name
+		m.samples(func(suffix, labels string, value float64) {
+			values[name + suffix + labels] = value
+		})
+	}
+	return values
+}
+
+// The http.Handler serving the metrics in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func quoteLabel(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("quests_total", "The number of quests")
+	cv := r.NewCounterVec("exceptions_total", "The number of exceptions", "name")
+	g := r.NewGauge("connections", "")
+	r.NewGaugeFunc("queue_bytes", "", func() float64 { return 1024 })
+	h := r.NewHistogram("latency_seconds", "", []float64{0.1, 0.01, 1})
+
+	c.Add(3)
+	c.Inc()
+	cv.With("Ex\"1").Inc()
+	cv.With("Ex2").Add(2)
+	g.Set(5)
+	g.Add(-1)
+	for _, v := range []float64{0.005, 0.05, 0.05, 0.5, 5} {
+		h.Observe(v)
+	}
+
+	values := r.Values()
+	expected := map[string]float64{
+		"quests_total": 4,
+		`exceptions_total{name="Ex\"1"}`: 1,
+		`exceptions_total{name="Ex2"}`: 2,
+		"connections": 4,
+		"queue_bytes": 1024,
+		`latency_seconds_bucket{le="0.01"}`: 1,
+		`latency_seconds_bucket{le="0.1"}`: 3,
+		`latency_seconds_bucket{le="1"}`: 4,
+		`latency_seconds_bucket{le="+Inf"}`: 5,
+		"latency_seconds_count": 5,
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("%s=%v, should be %v", k, values[k], v)
+		}
+	}
+	if sum := values["latency_seconds_sum"]; sum < 5.604 || sum > 5.606 {
+		t.Errorf("Wrong sum %v", sum)
+	}
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	text := w.Body.String()
+	for _, line := range []string{
+		"# HELP quests_total The number of quests\n",
+		"# TYPE quests_total counter\n",
+		"quests_total 4\n",
+		"# TYPE latency_seconds histogram\n",
+		"latency_seconds_bucket{le=\"+Inf\"} 5\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("%q not found in:\n%s", line, text)
+		}
+	}
+}
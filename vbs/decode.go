@@ -547,9 +547,6 @@ again:
 		}
 		return
 	}
-
-	dec.err = xerr.Trace(&InvalidVbsError{})
-	return
 }
 
 func (dec *Decoder) unpackHeadOfList() (head _HeadInfo) {
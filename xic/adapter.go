@@ -23,6 +23,9 @@ type _Adapter struct {
 	endpoints string
 	state _AdapterState	// atomic
 
+	maxMessageSize int
+	maxFragmentedSize int
+
 	listeners []*_Listener
 	srvMap sync.Map
 	dftService atomic.Value
@@ -67,6 +70,9 @@ func newAdapter(engine *_Engine, name string, endpoints string) (*_Adapter, erro
 	}
 
 	adapter := &_Adapter{engine:engine, name:name}
+	setting := engine.setting
+	adapter.maxMessageSize = int(setting.IntDefault(name + ".MaxMessageSize", int64(engine.maxMessageSize)))
+	adapter.maxFragmentedSize = int(setting.IntDefault(name + ".MaxFragmentedSize", int64(engine.maxFragmentedSize)))
 
 	eps := []string{}
 	for _, endpoint := range strings.Split(endpoints, "@") {
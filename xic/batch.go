@@ -0,0 +1,343 @@
+package xic
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"halftwo/mangos/vbs"
+)
+
+/*
+   Proxy.InvokeBatch() sends the quests of a batch in one batch quest
+   message, whose body is a VBS list of the bodies of the quests. The
+   server dispatches the quests concurrently, and collects the answers
+   finished within _BATCH_ANSWER_DELAY after the first one in one batch
+   answer message, so a slow quest doesn't hold the answers of the others.
+   The partial answers of the streaming methods are sent individually.
+   Each Result of the batch is done independently when its answer received.
+
+   The batch quests and answers are split into several batch messages
+   no larger than the MaxMessageSize of the peer.
+
+   The batch messages are only sent to the peers that announced they can
+   receive them during the authentication (like compression). The
+   connections without authentication (xic.passport.auth not set) have no
+   handshake to announce it, so the quests and answers on them are always
+   sent individually.
+*/
+
+// The batch quest or the batch answer
+type _OutBatch struct {
+	msgType MsgType
+	quests []*_OutQuest	// nil for the batch answer
+	num int			// the number of the quests or answers
+	buf []byte		// built by Bytes() for the batch quest
+	pbuf *bytes.Buffer	// from the pool, see release()
+	parts []*_OutBatch	// the batches split from the batch quest, see buffer_batch()
+}
+
+var _ _OutMessage = (*_OutBatch)(nil)
+
+// The txids of the quests must be set
+func newOutBatchQuest(quests []*_OutQuest) *_OutBatch {
+	return &_OutBatch{msgType:BatchQuestMsgType, quests:quests, num:len(quests)}
+}
+
+// The answers are released
+func newOutBatchAnswer(answers []*_OutAnswer) *_OutBatch {
+	bodies := make([][]byte, len(answers))
+	for i, a := range answers {
+		bodies[i] = a.Bytes()[MsgHeaderSize:]
+	}
+	b := &_OutBatch{msgType:BatchAnswerMsgType, num:len(answers)}
+	b.encode(bodies)
+	for _, a := range answers {
+		a.release()
+	}
+	return b
+}
+
+func (b *_OutBatch) encode(bodies [][]byte) {
+	pb := getOutBuffer()
+	pb.Write(commonHeaderBytes[:])
+	if err := vbs.NewEncoder(pb).Encode(bodies); err != nil {
+		panic("vbs.Encoder error")
+	}
+	b.buf = pb.Bytes()
+	b.pbuf = pb
+	fillHeader(b.buf, b.msgType)
+}
+
+func (b *_OutBatch) Type() MsgType {
+	return b.msgType
+}
+
+func (b *_OutBatch) Bytes() []byte {
+	if b.buf == nil {
+		bodies := make([][]byte, len(b.quests))
+		for i, q := range b.quests {
+			bodies[i] = q.Bytes()[MsgHeaderSize:]
+		}
+		b.encode(bodies)
+	}
+	return b.buf
+}
+
+// Called after the batch is written, the batch can't be used any more
+func (b *_OutBatch) release() {
+	for _, q := range b.quests {
+		q.release()
+	}
+	b.quests = nil
+	for _, part := range b.parts {
+		// The quests are released above
+		part.quests = nil
+		part.release()
+	}
+	b.parts = nil
+	if b.pbuf != nil {
+		putOutBuffer(b.pbuf)
+		b.pbuf = nil
+		b.buf = nil
+	}
+}
+
+// The batch quest or the batch answer received
+type _InBatch struct {
+	msgType MsgType
+	items [][]byte
+}
+
+// If pooled is true, buf is returned to the pool after decoded successfully
+func newInBatch(msgType MsgType, buf []byte, pooled bool) (*_InBatch, error) {
+	b := &_InBatch{msgType:msgType}
+	// The decoder must copy the items out of the pooled buffer
+	dec := vbs.NewDecoderBytes(buf, !pooled)
+	if err := dec.Decode(&b.items); err != nil {
+		return nil, err
+	}
+	if pooled {
+		putInBuffer(buf)
+	}
+	return b, nil
+}
+
+// The quests and answers, single or batched
+func isQuestOrAnswer(t MsgType) bool {
+	return t == QuestMsgType || t == AnswerMsgType || t == BatchQuestMsgType || t == BatchAnswerMsgType
+}
+
+func (b *_InBatch) Type() MsgType {
+	return b.msgType
+}
+
+// The allowance of the VBS encoding of the list and its items
+const (
+	_BATCH_LIST_OVERHEAD = 16
+	_BATCH_ITEM_OVERHEAD = 10
+)
+
+// Split the items into groups no larger than limit after encoded in a
+// batch, return the end of each group. An item too large is in a group
+// alone. There is only one group if limit <= 0.
+func splitBatch(sizes []int, limit int) []int {
+	var ends []int
+	total := _BATCH_LIST_OVERHEAD
+	for i, size := range sizes {
+		size += _BATCH_ITEM_OVERHEAD
+		if limit > 0 && i > 0 && total + size > limit {
+			ends = append(ends, i)
+			total = _BATCH_LIST_OVERHEAD
+		}
+		total += size
+	}
+	if len(sizes) > 0 {
+		ends = append(ends, len(sizes))
+	}
+	return ends
+}
+
+// Append the batch quest to the write buffers, see buffer_msg().
+// The quests too large are failed alone, and the others are sent
+// individually if the peer can't receive the batch quest.
+func (con *_Connection) buffer_batch(b *_OutBatch) {
+	quests := make([]*_OutQuest, 0, len(b.quests))
+	for _, q := range b.quests {
+		if err := con.check_size(q); err != nil {
+			con.reject_quest(q, err)
+		} else {
+			quests = append(quests, q)
+		}
+	}
+
+	if !con.peerBatch {
+		for _, q := range quests {
+			con.buffer_msg(q)
+		}
+		return
+	}
+
+	sizes := make([]int, len(quests))
+	for i, q := range quests {
+		sizes[i] = len(q.Bytes()) - MsgHeaderSize
+	}
+	start := 0
+	for _, end := range splitBatch(sizes, con.peerMaxMessage) {
+		if end - start == 1 {
+			con.buffer_msg(quests[start])
+		} else if end - start == len(b.quests) {
+			con.buffer_bytes(b.Bytes(), b.msgType)
+		} else {
+			// Released with b, the buffer can't be released before flush()
+			part := newOutBatchQuest(quests[start:end])
+			b.parts = append(b.parts, part)
+			con.buffer_bytes(part.Bytes(), part.msgType)
+		}
+		start = end
+	}
+}
+
+// The answers of a batch finished within so long after the first one
+// are sent in one batch answer
+const _BATCH_ANSWER_DELAY = time.Millisecond * 2
+
+// Collect the answers of the twoway quests of a batch
+type _BatchAnswer struct {
+	mutex sync.Mutex
+	remaining int
+	delay time.Duration
+	answers []*_OutAnswer
+	timer *time.Timer	// to flush the answers collected, see add()
+}
+
+// answer is nil if the quest is not answered
+func (ba *_BatchAnswer) add(con *_Connection, answer *_OutAnswer) {
+	ba.mutex.Lock()
+	if answer != nil {
+		ba.answers = append(ba.answers, answer)
+	}
+	ba.remaining--
+	done := ba.remaining == 0
+	if done {
+		if ba.timer != nil {
+			ba.timer.Stop()
+			ba.timer = nil
+		}
+	} else if answer != nil && ba.timer == nil {
+		ba.timer = time.AfterFunc(ba.delay, func() { ba.flush(con) })
+	}
+	ba.mutex.Unlock()
+
+	if done {
+		ba.flush(con)
+	}
+}
+
+// Send the answers collected in batch answers no larger than the peer
+// can receive
+func (ba *_BatchAnswer) flush(con *_Connection) {
+	ba.mutex.Lock()
+	answers := ba.answers
+	ba.answers = nil
+	ba.timer = nil
+	ba.mutex.Unlock()
+
+	sizes := make([]int, len(answers))
+	for i, a := range answers {
+		sizes[i] = len(a.Bytes()) - MsgHeaderSize
+	}
+	start := 0
+	for _, end := range splitBatch(sizes, con.peerMaxMessage) {
+		if end - start == 1 {
+			con.sendMessage(answers[start])
+		} else {
+			con.sendMessage(newOutBatchAnswer(answers[start:end]))
+		}
+		start = end
+	}
+}
+
+// Queue the answer of the twoway quest, or add it to the batch answer
+func (con *_Connection) answerQuest(quest *_InQuest, answer *_OutAnswer) {
+	if quest.batch != nil {
+		quest.batch.add(con, answer)
+	} else {
+		con.sendMessage(answer)
+	}
+}
+
+// The twoway quest is not answered, answer may be nil
+func (con *_Connection) dropAnswer(quest *_InQuest, answer *_OutAnswer) {
+	if answer != nil {
+		answer.release()
+	}
+	// The answer is not queued, see send_loop()
+	con.numQ.Add(-1)
+	if quest.batch != nil {
+		quest.batch.add(con, nil)
+	}
+}
+
+func (con *_Connection) handleBatch(batch *_InBatch) {
+	ba := &_BatchAnswer{delay:_BATCH_ANSWER_DELAY}
+	quests := make([]*_InQuest, len(batch.items))
+	for i, item := range batch.items {
+		quests[i] = newInQuest(item, false)
+		if quests[i].txid != 0 {
+			quests[i].batch = ba
+			ba.remaining++
+		}
+	}
+
+	for _, quest := range quests {
+		if con.check_doable(quest) {
+			con.startQuestContext(quest)
+			go con.handleQuest(con.Adapter(), quest)
+		}
+	}
+}
+
+// Return the errors of the quests not sent, nil for the quests pending.
+// The errors are also set in the results.
+func (con *_Connection) invokeBatch(quests []*_OutQuest, results []*_Result) []error {
+	var err error
+	errs := make([]error, len(quests))
+	con.mutex.Lock()
+	err = con._wait_queue(false)
+	if err == nil {
+		if con.state <= con_ACTIVE {
+			// The quests too large are failed alone, see check_size()
+			sent := make([]*_OutQuest, 0, len(quests))
+			for i, q := range quests {
+				q.txid = con._generate_txid()
+				if con.state == con_ACTIVE {
+					if errs[i] = con.check_size(q); errs[i] != nil {
+						continue
+					}
+				}
+				results[i].txid = q.txid
+				results[i].con = con
+				con.pending[q.txid] = results[i]
+				sent = append(sent, q)
+			}
+			if len(sent) > 0 {
+				con.mq.PushBack(newOutBatchQuest(sent))
+				con.cond.Broadcast()
+			}
+		} else {
+			err = newException(ConnectionClosedException)
+		}
+	}
+	con.mutex.Unlock()
+
+	for i := range errs {
+		if err != nil {
+			errs[i] = err
+		}
+		if errs[i] != nil {
+			results[i].err = errs[i]
+		}
+	}
+	return errs
+}
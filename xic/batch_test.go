@@ -0,0 +1,166 @@
+package xic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	q1 := newOutQuest(1, "Demo", "echo", Context{}, map[string]any{"x":1})
+	q2 := newOutQuest(2, "Demo", "time", Context{"CALLER":"test"}, struct{}{})
+	b := newOutBatchQuest([]*_OutQuest{q1, q2})
+	buf := b.Bytes()
+	if b.Type() != BatchQuestMsgType || buf2header(buf).Type != BatchQuestMsgType {
+		t.Fatalf("Wrong batch quest type")
+	}
+
+	msg, err := DecodeMessage(buf2header(buf), buf[MsgHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ib, ok := msg.(*_InBatch)
+	if !ok || ib.Type() != BatchQuestMsgType || len(ib.items) != 2 {
+		t.Fatalf("Wrong batch quest decoded")
+	}
+	iq := newInQuest(ib.items[1], false)
+	if iq.txid != 2 || iq.service != "Demo" || iq.method != "time" || iq.ctx.GetString("CALLER", "") != "test" {
+		t.Errorf("Wrong quest in the batch %+v", iq)
+	}
+	b.release()
+
+	// The batch answer is sent after all the twoway quests are answered
+	engine := newEngineSetting(NewSetting())
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+	con := _newConnection(engine, true)
+	// The answers may be queued by the timer of _BatchAnswer
+	numQueued := func() int {
+		con.mutex.Lock()
+		defer con.mutex.Unlock()
+		return con.mq.Num()
+	}
+	popQueued := func() _OutMessage {
+		con.mutex.Lock()
+		defer con.mutex.Unlock()
+		return con.mq.PopFront()
+	}
+	ba := &_BatchAnswer{remaining:3, delay:time.Hour}
+	quests := []*_InQuest{{txid:1, batch:ba}, {txid:2, batch:ba}, {txid:3, batch:ba}}
+	con.numQ.Add(3)
+	con.answerQuest(quests[0], newOutAnswerNormal(1, map[string]any{"y":1}))
+	con.dropAnswer(quests[1], nil)
+	if numQueued() != 0 {
+		t.Fatalf("Batch answer sent too early")
+	}
+	con.answerQuest(quests[2], newOutAnswerNormal(3, map[string]any{"y":3}))
+	ob, ok := popQueued().(*_OutBatch)
+	if !ok || ob.Type() != BatchAnswerMsgType || ob.num != 2 || con.numQ.Load() != 2 {
+		t.Fatalf("Wrong batch answer")
+	}
+
+	buf = ob.Bytes()
+	msg, err = DecodeMessage(buf2header(buf), buf[MsgHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ib = msg.(*_InBatch)
+	if len(ib.items) != 2 {
+		t.Fatalf("Wrong number of answers %d", len(ib.items))
+	}
+	ia := newInAnswer(ib.items[1], false)
+	args := NewArguments()
+	if ia.txid != 3 || ia.status != answer_NORMAL || ia.DecodeArgs(args) != nil || args.GetInt("y") != 3 {
+		t.Errorf("Wrong answer in the batch %+v", ia)
+	}
+	ob.release()
+
+	// The answers collected are flushed after the delay
+	ba = &_BatchAnswer{remaining:2, delay:time.Millisecond * 10}
+	quests = []*_InQuest{{txid:4, batch:ba}, {txid:5, batch:ba}}
+	con.numQ.Add(2)
+	con.answerQuest(quests[0], newOutAnswerNormal(4, struct{}{}))
+	time.Sleep(time.Millisecond * 50)
+	if a, ok := popQueued().(*_OutAnswer); !ok || a.txid != 4 {
+		t.Fatalf("Answer not flushed after the delay")
+	}
+	con.dropAnswer(quests[1], nil)
+	if numQueued() != 0 {
+		t.Fatalf("Nothing should be sent without answers")
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	for _, c := range []struct{
+		sizes []int
+		limit int
+		ends []int
+	}{
+		{nil, 100, nil},
+		{[]int{10, 20, 30}, 0, []int{3}},
+		{[]int{10, 20, 30}, 1000, []int{3}},
+		{[]int{30, 30, 30}, 100, []int{2, 3}},
+		{[]int{200, 10, 200}, 100, []int{1, 2, 3}},
+	} {
+		if ends := splitBatch(c.sizes, c.limit); fmt.Sprint(ends) != fmt.Sprint(c.ends) {
+			t.Errorf("splitBatch(%v, %d) = %v, should be %v", c.sizes, c.limit, ends, c.ends)
+		}
+	}
+}
+
+type _BatchServant struct {
+	DefaultServant
+}
+
+func (s *_BatchServant) Xic_echo(cur Current, in _BenchArgs, out *_BenchArgs) error {
+	*out = in
+	return nil
+}
+
+func (s *_BatchServant) Xic_slow(cur Current, in _BenchArgs, out *_BenchArgs) error {
+	time.Sleep(time.Millisecond * 300)
+	*out = in
+	return nil
+}
+
+func TestInvokeBatch(t *testing.T) {
+	for _, auth := range []bool{true, false} {
+		ss := NewSetting()
+		ss.Set("test.MaxMessageSize", "1000")
+		cs := NewSetting()
+		cs.Set("xic.MaxMessageSize", "1000")
+		srv, cli, adapter, endpoint := startTestEngines(t, auth, ss, cs)
+		adapter.MustAddServant("Batch", &_BatchServant{})
+		prx, _ := cli.StringToProxy("Batch" + endpoint)
+
+		// Larger than the MaxMessageSize of the peer together
+		calls := make([]BatchCall, 6)
+		outs := make([]_BenchArgs, len(calls))
+		for i := range calls {
+			calls[i] = BatchCall{Method:"echo", In:_BenchArgs{Seq:i, Data:make([]byte, 300)}, Out:&outs[i]}
+		}
+		calls[0].Method = "slow"
+		if auth {
+			// Too large alone
+			calls[5].In = _BenchArgs{Seq:5, Data:make([]byte, 2000)}
+		}
+		results := prx.InvokeBatch(calls)
+
+		// Not held by the slow one
+		results[1].Wait()
+		if results[0].Done() {
+			t.Errorf("The answers should not wait for the slow quest, auth=%v", auth)
+		}
+		for i, res := range results {
+			res.Wait()
+			if auth && i == 5 {
+				if ex, ok := res.Err().(Exception); !ok || ex.Name() != MessageSizeException {
+					t.Errorf("The quest too large should fail with MessageSizeException: %v", res.Err())
+				}
+			} else if res.Err() != nil || outs[i].Seq != i || len(outs[i].Data) != 300 {
+				t.Errorf("Wrong result %d of batch, auth=%v: %v", i, auth, res.Err())
+			}
+		}
+		stopTestEngines(srv, cli)
+	}
+}
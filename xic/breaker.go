@@ -0,0 +1,210 @@
+package xic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"halftwo/mangos/dlog"
+)
+
+/*
+   Each endpoint of a proxy has a circuit breaker. The breaker trips
+   (from closed to open) after so many consecutive connection failures
+   or timeouts. While open, the invokes through the endpoint fail
+   immediately with CircuitOpenException. After the open period, the
+   breaker becomes half-open and lets one invoke through. If it succeeds,
+   the breaker is closed again, otherwise it is opened again.
+
+   The defaults are xic.breaker.failures (0 to disable the breakers) and
+   xic.breaker.open milliseconds, which can be overridden by the proxy
+   option "-cb:failures,open", e.g. "Demo -cb:3,5000 @tcp++3030".
+*/
+type _BreakerPolicy struct {
+	failures int
+	open time.Duration
+}
+
+const (
+	_DEFAULT_BREAKER_FAILURES = 0
+	_DEFAULT_BREAKER_OPEN = time.Second * 30
+)
+
+func newBreakerPolicy(setting Setting) *_BreakerPolicy {
+	bp := &_BreakerPolicy{}
+	bp.failures = int(setting.IntDefault("xic.breaker.failures", _DEFAULT_BREAKER_FAILURES))
+	bp.open = time.Millisecond * time.Duration(setting.IntDefault("xic.breaker.open", int64(_DEFAULT_BREAKER_OPEN / time.Millisecond)))
+	return bp
+}
+
+// Parse the proxy option "-cb:failures[,open]"
+func parseBreakerOption(s string, dft *_BreakerPolicy) (*_BreakerPolicy, bool) {
+	if !strings.HasPrefix(s, "-cb:") {
+		return nil, false
+	}
+	bp := *dft
+	s = s[len("-cb:"):]
+	k := strings.IndexByte(s, ',')
+	if k >= 0 {
+		open, err := strconv.Atoi(s[k+1:])
+		if err != nil || open < 0 {
+			return nil, false
+		}
+		bp.open = time.Millisecond * time.Duration(open)
+		s = s[:k]
+	}
+	failures, err := strconv.Atoi(s)
+	if err != nil || failures < 0 {
+		return nil, false
+	}
+	bp.failures = failures
+	return &bp, true
+}
+
+func (bp *_BreakerPolicy) String() string {
+	return fmt.Sprintf("-cb:%d,%d", bp.failures, bp.open / time.Millisecond)
+}
+
+type _BreakerState int
+
+const (
+	brk_CLOSED _BreakerState = iota
+	brk_OPEN
+	brk_HALF_OPEN
+)
+
+func (st _BreakerState) String() string {
+	switch st {
+	case brk_CLOSED:
+		return "closed"
+	case brk_OPEN:
+		return "open"
+	case brk_HALF_OPEN:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type _Breaker struct {
+	policy *_BreakerPolicy
+	service string
+	endpoint string
+
+	mutex sync.Mutex
+	state _BreakerState
+	failures int		// consecutive failures
+	openedAt time.Time
+	trial bool		// the invoke in half-open state is in progress
+	trips int
+}
+
+func newBreaker(policy *_BreakerPolicy, service, endpoint string) *_Breaker {
+	return &_Breaker{policy:policy, service:service, endpoint:endpoint}
+}
+
+// Local errors are connection failures or timeouts.
+// Remote exceptions don't trip the breaker.
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	ex, ok := err.(Exception)
+	if !ok {
+		return true
+	}
+	return !ex.IsRemote() && ex.Name() != CircuitOpenException
+}
+
+func (b *_Breaker) _set_state(state _BreakerState, reason string) {
+	dlog.Log("XIC.WARN", "Circuit breaker of endpoint %s of service %s changed from %s to %s, reason=%s",
+		b.endpoint, b.service, b.state, state, reason)
+	b.state = state
+}
+
+// Return false if the invoke should be rejected.
+// If reserve is true, the only invoke in half-open state is reserved.
+func (b *_Breaker) allow(now time.Time, reserve bool) bool {
+	if b.policy.failures <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case brk_OPEN:
+		if now.Before(b.openedAt.Add(b.policy.open)) {
+			return false
+		}
+		if reserve {
+			b._set_state(brk_HALF_OPEN, "open period expired")
+			b.trial = true
+		}
+		return true
+	case brk_HALF_OPEN:
+		if b.trial {
+			return false
+		}
+		if reserve {
+			b.trial = true
+		}
+		return true
+	}
+	return true
+}
+
+func (b *_Breaker) record(err error) {
+	if b.policy.failures <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if isCanceled(err) {
+		// Neither success nor failure, but the trial is over
+		if b.state == brk_HALF_OPEN {
+			b.trial = false
+		}
+		return
+	}
+	failed := isBreakerFailure(err)
+	switch b.state {
+	case brk_CLOSED:
+		if !failed {
+			b.failures = 0
+		} else {
+			b.failures++
+			if b.failures >= b.policy.failures {
+				b._trip(fmt.Sprintf("%d consecutive failures", b.failures))
+			}
+		}
+	case brk_HALF_OPEN:
+		b.trial = false
+		if !failed {
+			b.failures = 0
+			b._set_state(brk_CLOSED, "trial succeeded")
+		} else {
+			b._trip("trial failed")
+		}
+	}
+}
+
+func (b *_Breaker) _trip(reason string) {
+	b._set_state(brk_OPEN, reason)
+	b.openedAt = time.Now()
+	b.failures = 0
+	b.trips++
+}
+
+func (b *_Breaker) State() _BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+func (b *_Breaker) Trips() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.trips
+}
@@ -0,0 +1,59 @@
+package xic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	bp, ok := parseBreakerOption("-cb:2,100", &_BreakerPolicy{failures:5, open:time.Second})
+	if !ok || bp.failures != 2 || bp.open != time.Millisecond * 100 || bp.String() != "-cb:2,100" {
+		t.Fatalf("Bug in parseBreakerOption()")
+	}
+	if _, ok := parseBreakerOption("-cb:x", bp); ok {
+		t.Errorf("Bug in parseBreakerOption()")
+	}
+
+	b := newBreaker(bp, "Demo", "@tcp+localhost+3030")
+	fail := errors.New("connection refused")
+	now := time.Now()
+
+	b.record(fail)
+	if b.State() != brk_CLOSED || !b.allow(now, true) {
+		t.Fatalf("breaker opened too early")
+	}
+	b.record(fail)
+	if b.State() != brk_OPEN || b.allow(time.Now(), true) {
+		t.Fatalf("breaker not opened")
+	}
+
+	// Half-open, only one trial
+	later := time.Now().Add(time.Millisecond * 100)
+	if !b.allow(later, false) || !b.allow(later, true) || b.allow(later, true) {
+		t.Fatalf("wrong trial in half-open state")
+	}
+	if b.State() != brk_HALF_OPEN {
+		t.Fatalf("breaker not half-open")
+	}
+	b.record(fail)
+	if b.State() != brk_OPEN || b.Trips() != 2 {
+		t.Fatalf("breaker not opened again")
+	}
+
+	later = time.Now().Add(time.Millisecond * 100)
+	b.allow(later, true)
+	b.record(nil)
+	if b.State() != brk_CLOSED {
+		t.Fatalf("breaker not closed")
+	}
+
+	// Remote exceptions don't trip the breaker
+	ex := newEx(MethodNotFoundException, "")
+	ex.remote = true
+	b.record(ex)
+	b.record(ex)
+	if b.State() != brk_CLOSED {
+		t.Errorf("breaker opened by remote exception")
+	}
+}
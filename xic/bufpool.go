@@ -0,0 +1,69 @@
+package xic
+
+import (
+	"bytes"
+	"sync"
+)
+
+/*
+   The outgoing quests and answers are encoded into the pooled buffers,
+   which are returned to the pool after the messages are written.
+   The incoming messages not larger than _IN_BUFFER_SIZE are received
+   into the pooled buffers, which are returned to the pool after the
+   arguments are decoded. The large buffers are left to the GC.
+*/
+const (
+	_MAX_POOLED_OUT_BUFFER = 64 * 1024
+	_IN_BUFFER_SIZE = 4 * 1024
+)
+
+var outBufferPool = sync.Pool{
+	New: func() any { return &bytes.Buffer{} },
+}
+
+func getOutBuffer() *bytes.Buffer {
+	return outBufferPool.Get().(*bytes.Buffer)
+}
+
+func putOutBuffer(b *bytes.Buffer) {
+	if b.Cap() <= _MAX_POOLED_OUT_BUFFER {
+		b.Reset()
+		outBufferPool.Put(b)
+	}
+}
+
+var inBufferPool = sync.Pool{
+	New: func() any { return &[_IN_BUFFER_SIZE]byte{} },
+}
+
+// The returned buffer is from the pool if size is not larger than _IN_BUFFER_SIZE
+func getInBuffer(size int) []byte {
+	if size > _IN_BUFFER_SIZE {
+		return make([]byte, size)
+	}
+	p := inBufferPool.Get().(*[_IN_BUFFER_SIZE]byte)
+	return p[:size]
+}
+
+// buf must be returned by getInBuffer() and not used any more
+func putInBuffer(buf []byte) {
+	if cap(buf) == _IN_BUFFER_SIZE {
+		inBufferPool.Put((*[_IN_BUFFER_SIZE]byte)(buf[:_IN_BUFFER_SIZE]))
+	}
+}
+
+// The outgoing message with a pooled buffer
+type _PooledMessage interface {
+	release()
+}
+
+// Return the buffers of the written messages to the pool
+func releaseMessages(msgs []_OutMessage) []_OutMessage {
+	for i, msg := range msgs {
+		if m, ok := msg.(_PooledMessage); ok {
+			m.release()
+		}
+		msgs[i] = nil
+	}
+	return msgs[:0]
+}
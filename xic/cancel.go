@@ -0,0 +1,111 @@
+package xic
+
+import (
+	"context"
+)
+
+/*
+   When the client gives up an invoke by Result.Cancel(), the quest is
+   removed from the pending quests of the connection, and a CANCEL check
+   message with the txid is sent to the server. The server cancels the
+   context.Context of the quest (see Current.Context()) and drops the
+   answer. A streaming method is also stopped by the error returned from
+   Stream.Send(). The CANCEL message with an unknown txid is ignored,
+   since the quest may have been answered already. The CANCEL message is
+   sent in the same lane of the outgoing queue as the quest (see
+   OutMsgQueue), so it won't overtake the quest not sent yet.
+
+   The context.Context of all the quests of a connection are canceled
+   when the connection is closed.
+*/
+
+const ck_CANCEL = "CANCEL"
+
+type _CancelArgs struct {
+	Txid int64	`vbs:"txid"`
+}
+
+func isCanceled(err error) bool {
+	ex, ok := err.(Exception)
+	return ok && !ex.IsRemote() && ex.Name() == QuestCanceledException
+}
+
+// Called in the process_loop() before the quest dispatched,
+// so the CANCEL message following the quest won't be missed.
+func (con *_Connection) startQuestContext(quest *_InQuest) {
+	quest.cctx, quest.cancel = context.WithCancel(con.cctx)
+	if quest.txid != 0 {
+		con.mutex.Lock()
+		if con.cancels == nil {
+			con.cancels = make(map[int64]context.CancelFunc)
+		}
+		con.cancels[quest.txid] = quest.cancel
+		con.mutex.Unlock()
+	}
+}
+
+// Return true if the quest has been canceled by the client
+func (con *_Connection) endQuestContext(quest *_InQuest) bool {
+	canceled := false
+	if quest.txid != 0 {
+		con.mutex.Lock()
+		_, ok := con.cancels[quest.txid]
+		if ok {
+			delete(con.cancels, quest.txid)
+		}
+		canceled = !ok
+		con.mutex.Unlock()
+	}
+	quest.cancel()
+	return canceled
+}
+
+func (con *_Connection) cancelQuest(txid int64) {
+	con.mutex.Lock()
+	cancel, ok := con.cancels[txid]
+	if ok {
+		delete(con.cancels, txid)
+	}
+	if st, found := con.streams[txid]; found {
+		st.canceled = true
+		con.cond.Broadcast()
+	}
+	con.mutex.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+func (cur *_Current) Context() context.Context {
+	return cur.cctx
+}
+
+func (r *_Result) Cancel() {
+	con := r.con
+	if con == nil || r.done.Load() {
+		return
+	}
+
+	con.mutex.Lock()
+	res, ok := con.pending[r.txid]
+	ok = ok && res == r
+	if ok {
+		delete(con.pending, r.txid)
+		if con.byebye_ok() {
+			con.cond.Broadcast()
+		}
+	}
+	con.mutex.Unlock()
+
+	// The answer has been received if not found
+	if !ok {
+		return
+	}
+	// The CANCEL message must not overtake the quest still queued
+	c := newOutCheck(ck_CANCEL, &_CancelArgs{Txid:r.txid})
+	c.normal = !r.high
+	con.sendMessage(c)
+	r.err = newException(QuestCanceledException)
+	r.broadcast()
+}
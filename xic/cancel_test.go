@@ -0,0 +1,72 @@
+package xic
+
+import (
+	"testing"
+)
+
+func TestCancel(t *testing.T) {
+	engine := newEngineSetting(NewSetting())
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+	con := _newConnection(engine, true)
+
+	// Client side, the quest is still queued
+	quest := newOutQuest(5, "Demo", "echo", Context{}, struct{}{})
+	con.mq.PushBack(quest)
+	res := &_Result{txid:5, con:con}
+	res.cond.L = &res.mtx
+	con.pending[5] = res
+	res.Cancel()
+	if !res.Done() || !isCanceled(res.Err()) || len(con.pending) != 0 {
+		t.Fatalf("Bug in Result.Cancel()")
+	}
+	if con.mq.PopFront() != quest {
+		t.Fatalf("CANCEL overtook the quest")
+	}
+	check, ok := con.mq.PopFront().(*_OutCheck)
+	if !ok || con.mq.Num() != 0 {
+		t.Fatalf("CANCEL not sent")
+	}
+
+	// The CANCEL of the high priority quest is in the high priority lane
+	high := &_Result{txid:6, high:true, con:con}
+	high.cond.L = &high.mtx
+	con.pending[6] = high
+	con.mq.PushBack(quest)
+	high.Cancel()
+	if c, ok := con.mq.PopFront().(*_OutCheck); !ok || !isHighPriority(c) || con.mq.PopFront() != quest {
+		t.Fatalf("CANCEL of high priority quest not in the high priority lane")
+	}
+	msg, _ := DecodeMessage(buf2header(check.Bytes()), check.Bytes()[MsgHeaderSize:])
+	var args _CancelArgs
+	if c := msg.(*_InCheck); c.cmd != ck_CANCEL || c.DecodeArgs(&args) != nil || args.Txid != 5 {
+		t.Fatalf("Wrong CANCEL message")
+	}
+
+	// Server side
+	q1 := &_InQuest{txid:1, service:"Demo", method:"echo"}
+	q2 := &_InQuest{txid:2, service:"Demo", method:"echo"}
+	q3 := &_InQuest{service:"Demo", method:"notify"}
+	for _, q := range []*_InQuest{q1, q2, q3} {
+		con.startQuestContext(q)
+	}
+	cur := newCurrent(con, q1)
+	con.handleCheck(newInCheck(check.Bytes()[MsgHeaderSize:], false))	// unknown txid ignored
+	con.cancelQuest(1)
+	select {
+	case <-cur.Context().Done():
+	default:
+		t.Fatalf("Context of the quest not canceled")
+	}
+	if q2.cctx.Err() != nil {
+		t.Fatalf("Wrong quest canceled")
+	}
+	if !con.endQuestContext(q1) || con.endQuestContext(q2) || q2.cctx.Err() == nil {
+		t.Errorf("Bug in endQuestContext()")
+	}
+
+	con.close_and_reply(false)
+	if q3.cctx.Err() == nil {
+		t.Errorf("Context of the quest not canceled after the connection closed")
+	}
+}
@@ -2,8 +2,13 @@ package xic
 
 import (
 	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
 	"crypto/aes"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 
 	"halftwo/mangos/eax"
 	"halftwo/mangos/xerr"
@@ -53,49 +58,70 @@ func String2CipherSuite(s string) _CipherSuite {
 }
 
 type _Cipher struct {
+	suite _CipherSuite
+
 	ox *eax.EaxCtx
 	ix *eax.EaxCtx
 
 	oNonce [20]byte
 	iNonce [20]byte
-}
 
+	// Each direction is rekeyed independently, the new key is derived
+	// from the previous one of the same direction.
+	oKey []byte
+	iKey []byte
+	oEpoch atomic.Int64	// atomic, may be read outside the send and receive loops
+	iEpoch atomic.Int64
+	oCount int64		// number of messages encrypted with current oKey
+	oTime time.Time		// when the current oKey was set
+}
 
-func newXicCipher(suite _CipherSuite, keyInfo []byte, isServer bool) (*_Cipher, error) {
-	keyLen := 0
+func suiteKeyLen(suite _CipherSuite) int {
 	switch suite {
 	case AES128_EAX:
-		keyLen = 16
+		return 16
 	case AES192_EAX:
-		keyLen = 24
+		return 24
 	case AES256_EAX:
-		keyLen = 32
-	default:
-		return nil, xerr.Errorf("Unsupported CipherSuite %s", suite)
+		return 32
 	}
+	return 0
+}
 
-	c := &_Cipher{}
-
+func newEaxNonce(suite _CipherSuite, keyInfo []byte) (*eax.EaxCtx, [20]byte, error) {
 	var key [32]byte
+	keyLen := suiteKeyLen(suite)
 	copy(key[:keyLen], keyInfo)
 
+	nonce := sha1.Sum(keyInfo)
 	blockCipher, err := aes.NewCipher(key[:keyLen])
 	if err != nil {
-		return nil, xerr.Trace(err)
+		return nil, nonce, xerr.Trace(err)
 	}
 
-	c.ox, err = eax.NewEax(blockCipher)
+	ctx, err := eax.NewEax(blockCipher)
 	if err != nil {
 		panic("Can't reach here")
 	}
+	return ctx, nonce, nil
+}
+
+func newXicCipher(suite _CipherSuite, keyInfo []byte, isServer bool) (*_Cipher, error) {
+	if suiteKeyLen(suite) == 0 {
+		return nil, xerr.Errorf("Unsupported CipherSuite %s", suite)
+	}
 
-	c.ix, err = eax.NewEax(blockCipher)
+	c := &_Cipher{suite:suite}
+	var err error
+	c.ox, c.oNonce, err = newEaxNonce(suite, keyInfo)
 	if err != nil {
-		panic("Can't reach here")
+		return nil, err
+	}
+	c.ix, c.iNonce, err = newEaxNonce(suite, keyInfo)
+	if err != nil {
+		return nil, err
 	}
 
-	c.oNonce = sha1.Sum(keyInfo)
-	copy(c.iNonce[:], c.oNonce[:])
 	if (isServer) {
 		c.oNonce[len(c.oNonce)-1] |= 0x01;
 		c.iNonce[len(c.iNonce)-1] &^= 0x01;
@@ -103,9 +129,75 @@ func newXicCipher(suite _CipherSuite, keyInfo []byte, isServer bool) (*_Cipher,
 		c.iNonce[len(c.iNonce)-1] |= 0x01;
 		c.oNonce[len(c.oNonce)-1] &^= 0x01;
 	}
+
+	c.oKey = keyInfo
+	c.iKey = keyInfo
+	c.oTime = time.Now()
 	return c, nil
 }
 
+// HKDF with SHA256, see RFC 5869
+func hkdfSha256(secret, salt, info []byte, length int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	out := make([]byte, 0, length + sha256.Size)
+	var t []byte
+	for i := 1; len(out) < length; i++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(t)
+		expander.Write(info)
+		expander.Write([]byte{byte(i)})
+		t = expander.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+func deriveRekey(key []byte, epoch int64) []byte {
+	info := fmt.Sprintf("XIC-REKEY-%d", epoch)
+	return hkdfSha256(key, nil, []byte(info), sha256.Size)
+}
+
+// The lowest bit of the nonce tells the direction,
+// it should be kept after rekeying.
+func (c *_Cipher) RekeyOutput(epoch int64) error {
+	key := deriveRekey(c.oKey, epoch)
+	ox, nonce, err := newEaxNonce(c.suite, key)
+	if err != nil {
+		return err
+	}
+	nonce[len(nonce)-1] = (nonce[len(nonce)-1] &^ 0x01) | (c.oNonce[len(c.oNonce)-1] & 0x01)
+	c.ox = ox
+	c.oNonce = nonce
+	c.oKey = key
+	c.oEpoch.Store(epoch)
+	c.oCount = 0
+	c.oTime = time.Now()
+	return nil
+}
+
+func (c *_Cipher) RekeyInput(epoch int64) error {
+	if epoch != c.iEpoch.Load() + 1 {
+		return xerr.Errorf("Unexpected rekey epoch %d, current is %d", epoch, c.iEpoch.Load())
+	}
+	key := deriveRekey(c.iKey, epoch)
+	ix, nonce, err := newEaxNonce(c.suite, key)
+	if err != nil {
+		return err
+	}
+	nonce[len(nonce)-1] = (nonce[len(nonce)-1] &^ 0x01) | (c.iNonce[len(c.iNonce)-1] & 0x01)
+	c.ix = ix
+	c.iNonce = nonce
+	c.iKey = key
+	c.iEpoch.Store(epoch)
+	return nil
+}
+
 func counterAdd2(counter []byte) {
 	for i := len(counter)-1; i >= 0; i-- {
 		counter[i]++
@@ -122,6 +214,7 @@ func counterAdd2(counter []byte) {
 }
 
 func (c *_Cipher) OutputStart(header []byte) {
+	c.oCount++
 	counterAdd2(c.oNonce[:])
 	c.ox.Start(true, c.oNonce[:], header)
 }
@@ -3,6 +3,7 @@ package xic
 import (
 	"testing"
 	"bytes"
+	"encoding/hex"
 	"math/rand"
 )
 
@@ -42,3 +43,100 @@ func TestCipher(t *testing.T) {
 	}
 }
 
+func TestHkdf(t *testing.T) {
+	// RFC 5869, Test Case 1
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+
+	out := hkdfSha256(ikm, salt, info, 42)
+	if hex.EncodeToString(out) != okm {
+		t.Errorf("hkdfSha256() failed, got %x", out)
+	}
+}
+
+func TestCipherRekey(t *testing.T) {
+	keyInfo := make([]byte, 32)
+	getRandomBytes(keyInfo)
+	srv, _ := newXicCipher(AES128_EAX, keyInfo, true)
+	cli, _ := newXicCipher(AES128_EAX, keyInfo, false)
+
+	var header [8]byte
+	var cipher, plain, out [100]byte
+	var mac [16]byte
+	getRandomBytes(plain[:])
+
+	for epoch := int64(1); epoch <= 3; epoch++ {
+		if err := srv.RekeyOutput(epoch); err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.RekeyInput(epoch); err != nil {
+			t.Fatal(err)
+		}
+
+		srv.OutputStart(header[:])
+		srv.OutputUpdate(cipher[:], plain[:])
+		srv.OutputFinish(mac[:])
+
+		cli.InputStart(header[:])
+		cli.InputUpdate(out[:], cipher[:])
+		if !cli.InputFinish(mac[:]) || !bytes.Equal(out[:], plain[:]) {
+			t.Fatalf("test cipher rekey failed at epoch %d", epoch)
+		}
+	}
+
+	if cli.RekeyInput(5) == nil {
+		t.Errorf("RekeyInput() should fail on unexpected epoch")
+	}
+
+	// The REKEY in clear text may be forged
+	engine := newEngineSetting(NewSetting())
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+	con := _newConnection(engine, false)
+	con.cipher = cli
+	rekey := newOutCheck(ck_REKEY, &_RekeyArgs{Epoch:4}).Bytes()
+	check := newInCheck(rekey[MsgHeaderSize:], false)
+	if con.handleCheck(check) == nil || cli.iEpoch.Load() != 3 {
+		t.Errorf("REKEY in clear text should be refused")
+	}
+	check.encrypted = true
+	if err := con.handleCheck(check); err != nil || cli.iEpoch.Load() != 4 {
+		t.Errorf("Encrypted REKEY failed: %v", err)
+	}
+}
+
+func TestRekeyConnection(t *testing.T) {
+	ss := NewSetting()
+	ss.Set("xic.rekey.messages", "3")
+	cs := NewSetting()
+	cs.Set("xic.rekey.messages", "5")
+	srv, cli, _, endpoint := startTestEngines(t, true, ss, cs)
+	defer stopTestEngines(srv, cli)
+	prx, _ := cli.StringToProxy("Bench" + endpoint)
+
+	for i := 0; i < 50; i++ {
+		var out _BenchArgs
+		if err := prx.Invoke("echo", _BenchArgs{Seq:i}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Seq != i {
+			t.Fatalf("Wrong answer %d, should be %d", out.Seq, i)
+		}
+	}
+
+	ccons := cli.getAllConnections()
+	scons := srv.getAllConnections()
+	if len(ccons) != 1 || len(scons) != 1 || ccons[0].cipher == nil || scons[0].cipher == nil {
+		t.Fatalf("Encrypted connection not established")
+	}
+	cc, sc := ccons[0].cipher, scons[0].cipher
+	co, ci, so, si := cc.oEpoch.Load(), cc.iEpoch.Load(), sc.oEpoch.Load(), sc.iEpoch.Load()
+	if co < 5 || so < 10 {
+		t.Errorf("Not rekeyed enough, client epoch=%d server epoch=%d", co, so)
+	}
+	if co != si || so != ci {
+		t.Errorf("Epochs mismatched, client=%d/%d server=%d/%d", co, ci, so, si)
+	}
+}
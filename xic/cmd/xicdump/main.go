@@ -0,0 +1,167 @@
+// xicdump decodes the xic frames in a captured byte stream of one
+// direction of a connection, e.g. the TCP payload extracted from a pcap
+// file with "Follow TCP Stream" of Wireshark and saved as raw.
+//
+// Usage: xicdump [-v] [file]
+//
+// The stream is read from stdin if the file is not given or is "-".
+// Each frame is printed with its offset, type, flags and body size,
+// followed by the decoded quest, answer or check message. The blobs
+// longer than 32 bytes are truncated unless -v is given.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"halftwo/mangos/xic"
+)
+
+var verbose = false
+
+func formatBlob(b []byte) string {
+	if !verbose && len(b) > 32 {
+		return fmt.Sprintf("b%q...(%d bytes)", b[:32], len(b))
+	}
+	return fmt.Sprintf("b%q", b)
+}
+
+// Format the value decoded by vbs, with the keys of the dicts sorted
+func format(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", x)
+	case []byte:
+		return formatBlob(x)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		items := make([]string, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			items = append(items, format(iter.Key().Interface()) + ":" + format(iter.Value().Interface()))
+		}
+		sort.Strings(items)
+		return "{" + strings.Join(items, ", ") + "}"
+	case reflect.Slice, reflect.Array:
+		items := make([]string, rv.Len())
+		for i := range items {
+			items[i] = format(rv.Index(i).Interface())
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+func statusName(status int) string {
+	switch status {
+	case 0:
+		return "normal"
+	case -1:
+		return "exception"
+	case 1:
+		return "partial"
+	}
+	return "unknown"
+}
+
+func printItem(f *xic.Frame) {
+	if f.Err != nil {
+		fmt.Printf("\t[error] %s\n", f.Err.Error())
+		return
+	}
+
+	switch f.Type {
+	case xic.QuestMsgType:
+		if f.Txid == 0 {
+			fmt.Printf("\tQUEST oneway %s::%s\n", f.Service, f.Method)
+		} else {
+			fmt.Printf("\tQUEST txid=%d %s::%s\n", f.Txid, f.Service, f.Method)
+		}
+		fmt.Printf("\tctx=%s\n", format(map[string]any(f.Ctx)))
+		fmt.Printf("\targs=%s\n", format(map[string]any(f.Args)))
+	case xic.AnswerMsgType:
+		fmt.Printf("\tANSWER txid=%d status=%d(%s)\n", f.Txid, f.Status, statusName(f.Status))
+		fmt.Printf("\targs=%s\n", format(map[string]any(f.Args)))
+	}
+}
+
+func printFrame(k int, f *xic.Frame) {
+	if f.Skipped > 0 {
+		fmt.Printf("... %d bytes skipped\n", f.Skipped)
+	}
+	fmt.Printf("#%d offset=%d magic=%c%c type=%c flags=%s size=%d", k, f.Offset,
+		f.Magic, f.Version, f.Type, f.FlagsString(), f.BodySize)
+	switch {
+	case f.Encrypted():
+		fmt.Printf(" [encrypted]\n")
+		return
+	case f.More():
+		fmt.Printf(" [fragment]\n")
+		return
+	case f.Err != nil:
+		fmt.Printf(" [error] %s\n", f.Err.Error())
+		return
+	}
+	fmt.Printf("\n")
+
+	switch f.Type {
+	case xic.QuestMsgType, xic.AnswerMsgType:
+		printItem(f)
+	case xic.BatchQuestMsgType, xic.BatchAnswerMsgType:
+		fmt.Printf("\tBATCH items=%d\n", len(f.Items))
+		for _, it := range f.Items {
+			printItem(it)
+		}
+	case xic.CheckMsgType:
+		fmt.Printf("\tCHECK %s\n", f.Cmd)
+		fmt.Printf("\targs=%s\n", format(map[string]any(f.Args)))
+	case xic.HelloMsgType:
+		fmt.Printf("\tHELLO\n")
+	case xic.ByeMsgType:
+		fmt.Printf("\tBYE\n")
+	}
+}
+
+func run(args []string) error {
+	if len(args) > 0 && args[0] == "-v" {
+		verbose = true
+		args = args[1:]
+	}
+
+	var r io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	d := xic.NewDissector(r)
+	for k := 1; ; k++ {
+		f, err := d.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		printFrame(k, f)
+	}
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
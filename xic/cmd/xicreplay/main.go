@@ -0,0 +1,205 @@
+// xicreplay re-sends the quests recorded by the engine (see xic.record.file)
+// to a target proxy, and diffs the new answers against the recorded ones.
+//
+// Usage: xicreplay [--xic.conf=<config_file>] [--AAA.BBB=ZZZ] <record_file> <proxy> [num]
+//
+// If the proxy begins with "@", e.g. "@tcp++5555", the service of each
+// record is prepended to it. The trace context and XIC_REQID in the
+// recorded Context are removed before sending, so the replayed quests are
+// neither traced as the recorded ones nor deduplicated. At most num records are replayed if num is
+// given and greater than 0.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"halftwo/mangos/vbs"
+	"halftwo/mangos/xic"
+)
+
+type _Replayer struct {
+	engine xic.Engine
+	target string
+	proxies map[string]xic.Proxy
+	same int
+	diff int
+	failed int
+}
+
+func (rp *_Replayer) proxy(service string) (xic.Proxy, error) {
+	if prx, ok := rp.proxies[service]; ok {
+		return prx, nil
+	}
+	s := rp.target
+	if strings.HasPrefix(s, "@") {
+		s = service + s
+	}
+	prx, err := rp.engine.StringToProxy(s)
+	if err != nil {
+		return nil, err
+	}
+	rp.proxies[service] = prx
+	return prx, nil
+}
+
+func decodeArgs(buf []byte) (xic.Arguments, error) {
+	args := xic.NewArguments()
+	if len(buf) > 0 {
+		if _, err := vbs.Unmarshal(buf, &args); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// Return the differences between the recorded and the replayed answers
+func diffArgs(recorded, replayed xic.Arguments) []string {
+	keys := map[string]bool{}
+	for k := range recorded {
+		keys[k] = true
+	}
+	for k := range replayed {
+		keys[k] = true
+	}
+	var names []string
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var diffs []string
+	for _, k := range names {
+		v1, ok1 := recorded[k]
+		v2, ok2 := replayed[k]
+		switch {
+		case !ok1:
+			diffs = append(diffs, fmt.Sprintf("+ %s: %#v", k, v2))
+		case !ok2:
+			diffs = append(diffs, fmt.Sprintf("- %s: %#v", k, v1))
+		case !reflect.DeepEqual(v1, v2):
+			diffs = append(diffs, fmt.Sprintf("- %s: %#v", k, v1), fmt.Sprintf("+ %s: %#v", k, v2))
+		}
+	}
+	return diffs
+}
+
+// Removed from the recorded Context
+var strippedKeys = map[string]bool{"XIC_TRACE":true, "XIC_SPAN":true, "XIC_SAMPLED":true, "XIC_REQID":true}
+
+// Return the differences between the recorded and the replayed answers
+func (rp *_Replayer) invoke(rec *xic.Record) (diffs []string, duration time.Duration, err error) {
+	in, err := decodeArgs(rec.Args)
+	if err != nil {
+		return
+	}
+	prx, err := rp.proxy(rec.Service)
+	if err != nil {
+		return
+	}
+	ctx := xic.NewContext()
+	for k, v := range rec.Ctx {
+		if !strippedKeys[k] {
+			ctx[k] = v
+		}
+	}
+
+	start := time.Now()
+	if rec.Oneway {
+		err = prx.InvokeCtxOneway(ctx, rec.Method, in)
+		return nil, time.Since(start), err
+	}
+
+	recorded, err := decodeArgs(rec.Answer)
+	if err != nil {
+		return
+	}
+	replayed := xic.NewArguments()
+	err = prx.InvokeCtx(ctx, rec.Method, in, replayed)
+	duration = time.Since(start)
+
+	if ex, ok := err.(xic.Exception); ok && ex.IsRemote() {
+		err = nil
+		if rec.Status == 0 {
+			diffs = append(diffs, "+ exception answered")
+		}
+		// The raiser and locus are not compared
+		delete(recorded, "raiser")
+		delete(recorded, "locus")
+		replayed = xic.Arguments{"message":ex.Message()}
+		if ex.Name() != "" {
+			replayed["exname"] = string(ex.Name())
+			replayed["code"] = int64(ex.Code())
+		}
+	} else if err != nil {
+		return
+	} else if rec.Status != 0 {
+		diffs = append(diffs, "- exception answered")
+	}
+	diffs = append(diffs, diffArgs(recorded, replayed)...)
+	return
+}
+
+func (rp *_Replayer) replay(k int, rec *xic.Record) {
+	title := fmt.Sprintf("#%d %s::%s %s", k, rec.Service, rec.Method,
+		time.UnixMicro(rec.Time).Format("2006-01-02 15:04:05.000000"))
+	diffs, duration, err := rp.invoke(rec)
+	timing := fmt.Sprintf("recorded=%dus replayed=%dus", rec.Duration, duration.Microseconds())
+	if err != nil {
+		rp.failed++
+		fmt.Printf("%s FAILED --- %s\n", title, err.Error())
+	} else if len(diffs) > 0 {
+		rp.diff++
+		fmt.Printf("%s DIFFERENT %s\n", title, timing)
+		for _, d := range diffs {
+			fmt.Printf("\t%s\n", d)
+		}
+	} else {
+		rp.same++
+		fmt.Printf("%s same %s\n", title, timing)
+	}
+}
+
+func run(engine xic.Engine, args []string) error {
+	defer engine.Shutdown()
+	if len(args) < 3 {
+		return fmt.Errorf("Usage: %s [--xic.conf=<config_file>] <record_file> <proxy> [num]", args[0])
+	}
+	num := 0
+	if len(args) > 3 {
+		var err error
+		if num, err = strconv.Atoi(args[3]); err != nil {
+			return fmt.Errorf("Invalid num %#v", args[3])
+		}
+	}
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rp := &_Replayer{engine:engine, target:args[2], proxies:map[string]xic.Proxy{}}
+	rr := xic.NewRecordReader(file)
+	for k := 1; num <= 0 || k <= num; k++ {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		rp.replay(k, rec)
+	}
+	fmt.Printf("same=%d different=%d failed=%d\n", rp.same, rp.diff, rp.failed)
+	return nil
+}
+
+func main() {
+	xic.Run(run)
+}
@@ -0,0 +1,64 @@
+package xic
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+/*
+   The quest and answer messages with body larger than xic.compress.threshold
+   bytes are compressed with deflate and flagged with FLAG_COMPRESS, if the
+   peer announced that it can decompress messages during the authentication.
+   The connections without authentication (xic.passport.auth not set) have
+   no handshake to announce it, so the messages on them are never compressed.
+   The body is compressed before encrypted, and decrypted before decompressed.
+   The decompressed body is limited to MaxMessageSize.
+*/
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// Return nil if the compressed message is not smaller
+func compressMessage(buf []byte) []byte {
+	b := bytes.NewBuffer(make([]byte, 0, len(buf)))
+	b.Write(buf[:MsgHeaderSize])
+
+	w := flateWriterPool.Get().(*flate.Writer)
+	w.Reset(b)
+	_, err := w.Write(buf[MsgHeaderSize:])
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriterPool.Put(w)
+	if err != nil || b.Len() >= len(buf) {
+		return nil
+	}
+
+	cbuf := b.Bytes()
+	hdr := buf2header(cbuf[:MsgHeaderSize])
+	hdr.Flags |= FLAG_COMPRESS
+	hdr.BodySize = int32(len(cbuf) - MsgHeaderSize)
+	hdr.FillBuffer(cbuf[:MsgHeaderSize])
+	return cbuf
+}
+
+func decompressBody(body []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+
+	b := &bytes.Buffer{}
+	n, err := io.Copy(b, io.LimitReader(r, int64(limit) + 1))
+	if err != nil {
+		return nil, newExf(ProtocolException, "Failed to decompress message: %s", err.Error())
+	}
+	if n > int64(limit) {
+		return nil, newExf(ProtocolException, "Message size too large, should less than %d", limit)
+	}
+	return b.Bytes(), nil
+}
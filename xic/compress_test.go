@@ -0,0 +1,44 @@
+package xic
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressMessage(t *testing.T) {
+	args := map[string]any{"keys": bytes.Repeat([]byte("key:0123456789,"), 1000)}
+	q := newOutQuest(1, "Demo", "batch", Context{}, args)
+	buf := append([]byte(nil), q.Bytes()...)
+
+	cbuf := compressMessage(buf)
+	if cbuf == nil || len(cbuf) >= len(buf) {
+		t.Fatalf("Bug in compressMessage()")
+	}
+	hdr := buf2header(cbuf[:MsgHeaderSize])
+	if hdr.Flags != FLAG_COMPRESS || int(hdr.BodySize) != len(cbuf) - MsgHeaderSize || hdr.Type != QuestMsgType {
+		t.Fatalf("Wrong header %v", hdr)
+	}
+	if err := checkHeader(hdr, MaxMessageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := decompressBody(cbuf[MsgHeaderSize:], MaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, buf[MsgHeaderSize:]) {
+		t.Errorf("Bug in decompressBody()")
+	}
+
+	if _, err = decompressBody(cbuf[MsgHeaderSize:], len(body) - 1); err == nil {
+		t.Errorf("decompressBody() should fail")
+	}
+	if _, err = decompressBody([]byte("not deflated"), MaxMessageSize); err == nil {
+		t.Errorf("decompressBody() should fail")
+	}
+
+	// Incompressible
+	if compressMessage(buf[:MsgHeaderSize + 2]) != nil {
+		t.Errorf("compressMessage() should return nil")
+	}
+}
@@ -2,7 +2,10 @@ package xic
 
 import (
 	"bytes"
-	"container/list"
+	"context"
+	crand "crypto/rand"
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"math/big"
@@ -44,7 +47,22 @@ type _Connection struct {
 	engine          *_Engine
 	adapter         atomic.Value // Adapter
 	serviceHint     string
+	service		string	// refreshed in the resolver if failed to connect
 	cipher          *_Cipher
+	peerRekey	bool
+	peerCompress	bool	// the peer can decompress messages
+	peerBatch	bool	// the peer can receive batch messages
+	peerIdentity	string	// the identity authenticated, "" if not authenticated
+	fixed		atomic.Bool	// used by a fixed proxy, see dropConnection()
+	maxMessageSize	int
+	maxFragmentedSize int	// 0 if fragmented messages are not accepted
+	peerMaxMessage	int
+	peerMaxFragmented int
+	fragments	[]byte	// the received fragments of a message
+	fragHeader	_MessageHeader
+	wbufs		net.Buffers	// the frames to write, see buffer_frame()
+	wsize		int
+	macs		[]byte
 	timeout         time.Duration
 	closeTimeout	time.Duration
 	connectTimeout	time.Duration
@@ -53,40 +71,123 @@ type _Connection struct {
 	endpoint        *EndpointInfo
 	lastTxid        int64
 	pending         map[int64]*_Result
+	streams		map[int64]*_ServerStream
+	cctx		context.Context		// the parent of the contexts of the quests
+	ccancel		context.CancelFunc
+	cancels		map[int64]context.CancelFunc	// of the twoway quests being served
 	mq              OutMsgQueue
+	queueWaiters	int	// the invokes waiting for the room in mq
 	mutex           sync.Mutex
 	cond		sync.Cond
 	err             error
 	_str		string
 }
 
+/*
+   OutMsgQueue is the queue of the outgoing messages, which has a high
+   priority lane and a normal lane, see isHighPriority().
+   The zero value is an empty queue.
+*/
 type OutMsgQueue struct {
-	lst *list.List
-	num int
+	high _MsgRing
+	normal _MsgRing
 }
 
 func (q *OutMsgQueue) Clear() {
-	q.lst.Init()
-	q.num = 0
+	q.high.Clear()
+	q.normal.Clear()
 }
 
 func (q *OutMsgQueue) Num() int {
-	return q.num
+	return q.high.num + q.normal.num
+}
+
+// The number of messages in the high priority lane
+func (q *OutMsgQueue) NumHigh() int {
+	return q.high.num
+}
+
+// The total size of the messages in the queue
+func (q *OutMsgQueue) Bytes() int {
+	return q.high.bytes + q.normal.bytes
 }
 
 func (q *OutMsgQueue) PushBack(msg _OutMessage) {
-	q.lst.PushBack(msg)
-	q.num++
+	if isHighPriority(msg) {
+		q.high.PushBack(msg)
+	} else {
+		q.normal.PushBack(msg)
+	}
 }
 
+// The messages in the high priority lane are popped first
 func (q *OutMsgQueue) PopFront() _OutMessage {
-	e := q.lst.Front()
-	if e == nil {
+	if q.high.num > 0 {
+		return q.high.PopFront()
+	}
+	return q.normal.PopFront()
+}
+
+/*
+   _MsgRing is a ring buffer of the outgoing messages.
+   It is pushed and popped for every message, so a slice is used instead
+   of a container/list, which allocates an element for each message.
+   The zero value is an empty ring.
+*/
+type _MsgRing struct {
+	buf []_OutMessage
+	head int
+	num int
+	bytes int
+}
+
+const _MIN_OUT_QUEUE_SIZE = 16
+
+func (q *_MsgRing) Clear() {
+	q.buf = nil
+	q.head = 0
+	q.num = 0
+	q.bytes = 0
+}
+
+func (q *_MsgRing) grow() {
+	size := len(q.buf) * 2
+	if size < _MIN_OUT_QUEUE_SIZE {
+		size = _MIN_OUT_QUEUE_SIZE
+	}
+	buf := make([]_OutMessage, size)
+	n := copy(buf, q.buf[q.head:])
+	copy(buf[n:], q.buf[:q.head])
+	q.buf = buf
+	q.head = 0
+}
+
+func (q *_MsgRing) PushBack(msg _OutMessage) {
+	if q.num == len(q.buf) {
+		q.grow()
+	}
+	q.buf[(q.head + q.num) % len(q.buf)] = msg
+	q.num++
+	q.bytes += len(msg.Bytes())
+}
+
+func (q *_MsgRing) PopFront() _OutMessage {
+	if q.num == 0 {
 		return nil
 	}
-	q.lst.Remove(e)
+	msg := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) % len(q.buf)
 	q.num--
-	return e.Value.(_OutMessage)
+	q.bytes -= len(msg.Bytes())
+	if q.num == 0 {
+		q.head = 0
+		if len(q.buf) > _MIN_OUT_QUEUE_SIZE * 64 {
+			// Don't hold the memory after a burst
+			q.buf = nil
+		}
+	}
+	return msg
 }
 
 func _newConnection(engine *_Engine, incoming bool) *_Connection {
@@ -96,9 +197,9 @@ func _newConnection(engine *_Engine, incoming bool) *_Connection {
 		incoming: incoming,
 		maxQ: DEFAULT_CONNECTION_MAXQ,
 	}
-	con.mq = OutMsgQueue{lst:list.New()}
 	con.cond.L = &con.mutex
 	con.pending = make(map[int64]*_Result)
+	con.cctx, con.ccancel = context.WithCancel(context.Background())
 	return con
 }
 
@@ -119,8 +220,10 @@ func (con *_Connection) _set_timeouts(ei *EndpointInfo) {
 
 func newOutgoingConnection(engine *_Engine, serviceHint string, ei *EndpointInfo) *_Connection {
 	con := _newConnection(engine, false)
+	con.maxMessageSize = engine.maxMessageSize
+	con.maxFragmentedSize = engine.maxFragmentedSize
 	con.endpoint = ei
-	con.adapter.Store(engine.slackAdapter)
+	con.service = serviceHint
 
 	con._set_timeouts(ei)
 	go con.client_run()
@@ -130,6 +233,8 @@ func newOutgoingConnection(engine *_Engine, serviceHint string, ei *EndpointInfo
 func newIncomingConnection(listener *_Listener, c net.Conn) *_Connection {
 	adapter := listener.adapter
 	con := _newConnection(adapter.engine, true)
+	con.maxMessageSize = adapter.maxMessageSize
+	con.maxFragmentedSize = adapter.maxFragmentedSize
 	con.c = c
 	con.endpoint = listener.endpoint
 	con.adapter.Store(adapter)
@@ -233,6 +338,7 @@ func (con *_Connection) close_and_reply(retryable bool) {
 	if con.c != nil {
 		con.c.Close()
 	}
+	con.ccancel()
 
 	if len(pending) > 0 {
 		if err == nil {
@@ -266,18 +372,48 @@ func (con *_Connection) CreateFixedProxy(service string) (Proxy, error) {
 		return nil, err
 	}
 
+	con.fixed.Store(true)
 	prx := newProxyWithConnection(con.engine, service, con)
 	return prx, nil
 }
 
+// The outgoing connection uses the slack adapter of the engine,
+// which may be created after the connection.
 func (con *_Connection) Adapter() Adapter {
-	a := con.adapter.Load()
-	if a != nil {
-		return a.(Adapter)
+	if a, ok := con.adapter.Load().(*_Adapter); ok && a != nil {
+		return a
+	}
+	if !con.incoming {
+		if a := con.engine.getSlackAdapter(); a != nil {
+			return a
+		}
 	}
 	return nil
 }
 
+// Number of the invokes waiting for answers
+func (con *_Connection) numPending() int {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return len(con.pending)
+}
+
+func (con *_Connection) info() _ConnectionInfo {
+	ci := _ConnectionInfo{Connection:con.String(), Incoming:con.incoming}
+	if !con.incoming {
+		ci.Endpoint = con.Endpoint()
+	}
+	ci.Waiting = int(con.numQ.Load())
+	con.mutex.Lock()
+	ci.Pending = len(con.pending)
+	ci.QueueMessages = con.mq.Num()
+	ci.QueueHigh = con.mq.NumHigh()
+	ci.QueueBytes = con.mq.Bytes()
+	ci.QueueWaiters = con.queueWaiters
+	con.mutex.Unlock()
+	return ci
+}
+
 func (con *_Connection) _generate_txid() int64 {
 	con.lastTxid++
 	if con.lastTxid < 0 {
@@ -286,25 +422,81 @@ func (con *_Connection) _generate_txid() int64 {
 	return con.lastTxid
 }
 
-func (con *_Connection) invoke(prx *_Proxy, q *_OutQuest, res *_Result) {
-	ok := false
+// Only the quests are limited by xic.queue.messages and xic.queue.bytes.
+// The answers and check messages are always queued.
+func (con *_Connection) _queue_full() bool {
+	engine := con.engine
+	return (engine.queueMessages > 0 && con.mq.Num() >= engine.queueMessages) ||
+		(engine.queueBytes > 0 && con.mq.Bytes() >= engine.queueBytes)
+}
+
+// If the outgoing queue is full, wait until there is room in the queue
+// if xic.queue.block is true, or fail with ConnectionOverloadException
+// otherwise. The wait is bounded by the timeout of the connection if set.
+// The quests of the keeper service are always queued.
+// Called with con.mutex locked.
+func (con *_Connection) _wait_queue(keeper bool) error {
+	var deadline time.Time
+	for !keeper && con.state <= con_ACTIVE && con._queue_full() {
+		if !con.engine.queueBlock {
+			return newExf(ConnectionOverloadException, "Outgoing queue full, messages=%d bytes=%d", con.mq.Num(), con.mq.Bytes())
+		}
+		if con.timeout > 0 {
+			if deadline.IsZero() {
+				deadline = time.Now().Add(con.timeout)
+				// Wake up the waiters to check the deadline
+				timer := time.AfterFunc(con.timeout, func() {
+					con.mutex.Lock()
+					con.cond.Broadcast()
+					con.mutex.Unlock()
+				})
+				defer timer.Stop()
+			} else if !time.Now().Before(deadline) {
+				return newExf(ConnectionOverloadException, "Outgoing queue full for %v, messages=%d bytes=%d", con.timeout, con.mq.Num(), con.mq.Bytes())
+			}
+		}
+		con.queueWaiters++
+		con.cond.Wait()
+		con.queueWaiters--
+	}
+	return nil
+}
+
+// The invoke may be blocked, see _wait_queue().
+// The error is also set in res if res is not nil.
+func (con *_Connection) invoke(prx *_Proxy, q *_OutQuest, res *_Result) error {
+	var err error
 	con.mutex.Lock()
-	if con.state <= con_ACTIVE {
-		ok = true
-		if q.txid != 0 {
-			txid := con._generate_txid()
-			res.txid = txid
-			q.txid = txid
-			con.pending[txid] = res
+	err = con._wait_queue(q.keeper)
+	if err == nil {
+		if con.state <= con_ACTIVE {
+			if q.txid != 0 {
+				q.txid = con._generate_txid()
+			}
+			// The quests queued before active are checked in send_loop()
+			if con.state == con_ACTIVE {
+				err = con.check_size(q)
+			}
+			if err == nil {
+				if q.txid != 0 {
+					res.txid = q.txid
+					res.high = q.high
+					res.con = con
+					con.pending[q.txid] = res
+				}
+				con.mq.PushBack(q)
+				con.cond.Broadcast()
+			}
+		} else {
+			err = newException(ConnectionClosedException)
 		}
 	}
 	con.mutex.Unlock()
 
-	if ok {
-		con.sendMessage(q)
-	} else if res != nil {
-		res.err = newException(ConnectionClosedException)
+	if err != nil && res != nil {
+		res.err = err
 	}
+	return err
 }
 
 type _ForbiddenArgs struct {
@@ -326,11 +518,49 @@ type _S2Args struct {
 type _S3Args struct {
 	A  []byte `vbs:"A"`
 	M1 []byte `vbs:"M1"`
+	Rekey bool `vbs:"REKEY,omitempty"`
+	Compress bool `vbs:"COMPRESS,omitempty"`
+	MaxMsg int `vbs:"MAXMSG,omitempty"`
+	MaxFrag int `vbs:"MAXFRAG,omitempty"`
+	Batch bool `vbs:"BATCH,omitempty"`
 }
 type _S4Args struct {
 	M2     []byte `vbs:"M2"`
 	Cipher string `vbs:"CIPHER"`
 	Mode   int    `vbs:"MODE"`
+	Rekey bool `vbs:"REKEY,omitempty"`
+	Compress bool `vbs:"COMPRESS,omitempty"`
+	MaxMsg int `vbs:"MAXMSG,omitempty"`
+	MaxFrag int `vbs:"MAXFRAG,omitempty"`
+	Batch bool `vbs:"BATCH,omitempty"`
+}
+type _P1Args struct {
+	I string `vbs:"I"`
+	N []byte `vbs:"N"`
+}
+type _P2Args struct {
+	N []byte `vbs:"N"`
+}
+type _P3Args struct {
+	M1 []byte `vbs:"M1"`
+	Rekey bool `vbs:"REKEY,omitempty"`
+	Compress bool `vbs:"COMPRESS,omitempty"`
+	MaxMsg int `vbs:"MAXMSG,omitempty"`
+	MaxFrag int `vbs:"MAXFRAG,omitempty"`
+	Batch bool `vbs:"BATCH,omitempty"`
+}
+type _P4Args struct {
+	M2     []byte `vbs:"M2"`
+	Cipher string `vbs:"CIPHER"`
+	Mode   int    `vbs:"MODE"`
+	Rekey bool `vbs:"REKEY,omitempty"`
+	Compress bool `vbs:"COMPRESS,omitempty"`
+	MaxMsg int `vbs:"MAXMSG,omitempty"`
+	MaxFrag int `vbs:"MAXFRAG,omitempty"`
+	Batch bool `vbs:"BATCH,omitempty"`
+}
+type _RekeyArgs struct {
+	Epoch int64 `vbs:"epoch"`
 }
 
 func (con *_Connection) check_send(cmd string, args any) bool {
@@ -369,70 +599,200 @@ const (
 	ck_SRP6a2       = "SRP6a2"
 	ck_SRP6a3       = "SRP6a3"
 	ck_SRP6a4       = "SRP6a4"
+	ck_PSK1         = "PSK1"
+	ck_PSK2         = "PSK2"
+	ck_PSK3         = "PSK3"
+	ck_PSK4         = "PSK4"
+	ck_REKEY        = "REKEY"
 )
 
+const (
+	auth_SRP6a = "SRP6a"
+	auth_PSK   = "PSK"
+)
+
+const pskNonceSize = 32
+
+// HMAC-SHA256 of the tag, identity, both nonces and the previous proof
+// keyed by the pre-shared password
+func pskProof(password, tag, identity string, cNonce, sNonce, prev []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(tag))
+	mac.Write([]byte(identity))
+	mac.Write(cNonce)
+	mac.Write(sNonce)
+	mac.Write(prev)
+	return mac.Sum(nil)
+}
+
+func pskSessionKey(password, identity string, cNonce, sNonce []byte) []byte {
+	salt := make([]byte, 0, len(cNonce) + len(sNonce))
+	salt = append(salt, cNonce...)
+	salt = append(salt, sNonce...)
+	return hkdfSha256([]byte(password), salt, []byte("XIC-PSK " + identity), sha256.Size)
+}
+
 func (con *_Connection) server_handshake() bool {
 	var err error
 	con.set_state(con_HANDSHAKE)
-	if con.engine.shadowBox != nil {
-		var auth _AuthArgs
-		auth.Method = "SRP6a"
-		if !con.check_send(ck_AUTHENTICATE, &auth) {
-			goto done
+	if con.engine.authMethod == auth_PSK {
+		if !con.server_psk() {
+			return false
 		}
-
-		var s1 _S1Args
-		if !con.check_expect(ck_SRP6a1, &s1) {
-			goto done
+	} else if shadowBox := con.engine.shadowBox.Load(); shadowBox != nil {
+		if !con.server_srp6a(shadowBox) {
+			return false
 		}
+	}
 
-		v := con.engine.shadowBox.GetVerifier(s1.I)
-		if v == nil {
-			err = newEx(AuthFailedException, "No such identity")
-			goto done
-		}
+	err = con.send_msg(theHelloMessage)
+	if err != nil {
+		con.set_error(err)
+		return false
+	}
+	return true
+}
 
-		var srp6svr *srp6a.Srp6aServer
-		var s2 _S2Args
-		srp6svr, err = con.engine.shadowBox.CreateSrp6aServer(v.ParamId, v.HashId)
-		if err != nil {
-			goto done
-		}
-		srp6svr.SetV(v.Verifier)
-		s2.Hash = srp6svr.HashName()
-		s2.N = srp6svr.N()
-		s2.Gen = srp6svr.G()
-		s2.Salt = v.Salt
-		s2.B = srp6svr.GenerateB()
-		if !con.check_send(ck_SRP6a2, &s2) {
-			goto done
-		}
+func (con *_Connection) server_srp6a(shadowBox *ShadowBox) bool {
+	var err error
+	var auth _AuthArgs
+	var srp6svr *srp6a.Srp6aServer
+	var s2 _S2Args
+	var s3 _S3Args
+	var s4 _S4Args
+	var M1 []byte
+	cihper_suite := con.engine.cipher
+	auth.Method = auth_SRP6a
+	if !con.check_send(ck_AUTHENTICATE, &auth) {
+		return false
+	}
 
-		var s3 _S3Args
-		con.check_expect(ck_SRP6a3, &s3)
-		srp6svr.SetA(s3.A)
-		M1 := srp6svr.ComputeM1()
-		if !bytes.Equal(M1, s3.M1) {
-			err = newEx(AuthFailedException, "srp6a M1 not equal")
-			goto done
-		}
+	var s1 _S1Args
+	if !con.check_expect(ck_SRP6a1, &s1) {
+		return false
+	}
 
-		cihper_suite := con.engine.cipher
-		var s4 _S4Args
-		s4.M2 = srp6svr.ComputeM2()
-		s4.Cipher = cihper_suite.String()
-		s4.Mode = 1
-		if !con.check_send(ck_SRP6a4, &s4) {
-			goto done
-		}
+	v := shadowBox.GetVerifier(s1.I)
+	if v == nil {
+		err = newEx(AuthFailedException, "No such identity")
+		goto done
+	}
 
-		key := srp6svr.ComputeK()
-		if con.cipher, err = newXicCipher(cihper_suite, key, true); err != nil {
-			goto done
-		}
+	srp6svr, err = shadowBox.CreateSrp6aServer(v.ParamId, v.HashId)
+	if err != nil {
+		goto done
+	}
+	srp6svr.SetV(v.Verifier)
+	s2.Hash = srp6svr.HashName()
+	s2.N = srp6svr.N()
+	s2.Gen = srp6svr.G()
+	s2.Salt = v.Salt
+	s2.B = srp6svr.GenerateB()
+	if !con.check_send(ck_SRP6a2, &s2) {
+		return false
 	}
 
-	err = con.send_msg(theHelloMessage)
+	con.check_expect(ck_SRP6a3, &s3)
+	con.peerRekey = s3.Rekey
+	con.peerCompress = s3.Compress
+	con.peerMaxMessage = s3.MaxMsg
+	con.peerMaxFragmented = s3.MaxFrag
+	con.peerBatch = s3.Batch
+	srp6svr.SetA(s3.A)
+	M1 = srp6svr.ComputeM1()
+	if !bytes.Equal(M1, s3.M1) {
+		err = newEx(AuthFailedException, "srp6a M1 not equal")
+		goto done
+	}
+	con.peerIdentity = s1.I
+
+	s4.M2 = srp6svr.ComputeM2()
+	s4.Cipher = cihper_suite.String()
+	s4.Mode = 1
+	s4.Rekey = true
+	s4.Compress = true
+	s4.MaxMsg = con.maxMessageSize
+	s4.MaxFrag = con.maxFragmentedSize
+	s4.Batch = true
+	if !con.check_send(ck_SRP6a4, &s4) {
+		return false
+	}
+
+	con.cipher, err = newXicCipher(cihper_suite, srp6svr.ComputeK(), true)
+done:
+	if err != nil {
+		con.set_error(err)
+		return false
+	}
+	return true
+}
+
+func (con *_Connection) server_psk() bool {
+	var err error
+	var auth _AuthArgs
+	var password string
+	var p1 _P1Args
+	var p2 _P2Args
+	var p3 _P3Args
+	var p4 _P4Args
+	secretBox := con.engine.secretBox.Load()
+	cihper_suite := con.engine.cipher
+	auth.Method = auth_PSK
+	if !con.check_send(ck_AUTHENTICATE, &auth) {
+		return false
+	}
+
+	if !con.check_expect(ck_PSK1, &p1) {
+		return false
+	}
+
+	if secretBox != nil {
+		password = secretBox.FindIdentity(p1.I)
+	}
+	if password == "" {
+		err = newEx(AuthFailedException, "No such identity")
+		goto done
+	}
+	if len(p1.N) != pskNonceSize {
+		err = newEx(AuthFailedException, "Invalid psk nonce")
+		goto done
+	}
+
+	p2.N = make([]byte, pskNonceSize)
+	if _, err = crand.Read(p2.N); err != nil {
+		goto done
+	}
+	if !con.check_send(ck_PSK2, &p2) {
+		return false
+	}
+
+	if !con.check_expect(ck_PSK3, &p3) {
+		return false
+	}
+	con.peerRekey = p3.Rekey
+	con.peerCompress = p3.Compress
+	con.peerMaxMessage = p3.MaxMsg
+	con.peerMaxFragmented = p3.MaxFrag
+	con.peerBatch = p3.Batch
+	if !hmac.Equal(pskProof(password, "M1", p1.I, p1.N, p2.N, nil), p3.M1) {
+		err = newEx(AuthFailedException, "psk M1 not equal")
+		goto done
+	}
+	con.peerIdentity = p1.I
+
+	p4.M2 = pskProof(password, "M2", p1.I, p1.N, p2.N, p3.M1)
+	p4.Cipher = cihper_suite.String()
+	p4.Mode = 1
+	p4.Rekey = true
+	p4.Compress = true
+	p4.MaxMsg = con.maxMessageSize
+	p4.MaxFrag = con.maxFragmentedSize
+	p4.Batch = true
+	if !con.check_send(ck_PSK4, &p4) {
+		return false
+	}
+
+	con.cipher, err = newXicCipher(cihper_suite, pskSessionKey(password, p1.I, p1.N, p2.N), true)
 done:
 	if err != nil {
 		con.set_error(err)
@@ -451,69 +811,152 @@ func (con *_Connection) client_handshake() bool {
 			goto done
 		}
 
-		if auth.Method != "SRP6a" {
+		if auth.Method != auth_SRP6a && auth.Method != auth_PSK {
 			err = newEx(AuthFailedException, "Unknown auth method")
 			goto done
 		}
 
-		if con.engine.secretBox == nil {
+		secretBox := con.engine.secretBox.Load()
+		if secretBox == nil {
 			err = newEx(AuthFailedException, "No SecretBox supplied")
 			goto done
 		}
 
-		id, pass := con.engine.secretBox.FindEndpoint(con.serviceHint, con.endpoint)
+		id, pass := secretBox.FindEndpoint(con.serviceHint, con.endpoint)
 		if id == "" || pass == "" {
 			err = newEx(AuthFailedException, "No matched secret found")
 			goto done
 		}
 
-		srp6cl := srp6a.NewClientEmpty()
-		srp6cl.SetIdentity(id, pass)
-
-		var s1 _S1Args
-		s1.I = id
-		if !con.check_send(ck_SRP6a1, &s1) {
-			goto done
+		ok := false
+		if auth.Method == auth_PSK {
+			ok = con.client_psk(id, pass)
+		} else {
+			ok = con.client_srp6a(id, pass)
+		}
+		if !ok {
+			return false
 		}
 
-		var s2 _S2Args
-		con.check_expect(ck_SRP6a2, &s2)
-		g := new(big.Int).SetBytes(s2.Gen)
-		srp6cl.SetHash(s2.Hash)
-		srp6cl.SetParameter(int(g.Int64()), s2.N, len(s2.N)*8)
-		srp6cl.SetSalt(s2.Salt)
-		srp6cl.SetB(s2.B)
+		msg = con.must_read_msg()
+	}
 
-		var s3 _S3Args
-		s3.A = srp6cl.GenerateA()
-		s3.M1 = srp6cl.ComputeM1()
-		if !con.check_send(ck_SRP6a3, &s3) {
-			goto done
-		}
+	if msg != nil && msg.Type() != HelloMsgType {
+		err = newEx(ProtocolException, "Unexpected message received, expect Hello message")
+	}
+done:
+	if err != nil {
+		con.set_error(err)
+		return false
+	}
+	return true
+}
 
-		var s4 _S4Args
-		if !con.check_expect(ck_SRP6a4, &s4) {
-			goto done
-		}
+func (con *_Connection) client_srp6a(id, pass string) bool {
+	var err error
+	var M2 []byte
+	srp6cl := srp6a.NewClientEmpty()
+	srp6cl.SetIdentity(id, pass)
 
-		M2 := srp6cl.ComputeM2()
-		if !bytes.Equal(M2, s4.M2) {
-			err = newEx(AuthFailedException, "srp6a M2 not equal")
-			goto done
-		}
+	var s1 _S1Args
+	s1.I = id
+	if !con.check_send(ck_SRP6a1, &s1) {
+		return false
+	}
 
-		key := srp6cl.ComputeK()
-		suite := String2CipherSuite(s4.Cipher)
-		if con.cipher, err = newXicCipher(suite, key, false); err != nil {
-			goto done
-		}
+	var s2 _S2Args
+	con.check_expect(ck_SRP6a2, &s2)
+	g := new(big.Int).SetBytes(s2.Gen)
+	srp6cl.SetHash(s2.Hash)
+	srp6cl.SetParameter(int(g.Int64()), s2.N, len(s2.N)*8)
+	srp6cl.SetSalt(s2.Salt)
+	srp6cl.SetB(s2.B)
+
+	var s3 _S3Args
+	s3.A = srp6cl.GenerateA()
+	s3.M1 = srp6cl.ComputeM1()
+	s3.Rekey = true
+	s3.Compress = true
+	s3.MaxMsg = con.maxMessageSize
+	s3.MaxFrag = con.maxFragmentedSize
+	s3.Batch = true
+	if !con.check_send(ck_SRP6a3, &s3) {
+		return false
+	}
 
-		msg = con.must_read_msg()
+	var s4 _S4Args
+	if !con.check_expect(ck_SRP6a4, &s4) {
+		return false
 	}
 
-	if msg != nil && msg.Type() != HelloMsgType {
-		err = newEx(ProtocolException, "Unexpected message received, expect Hello message")
+	M2 = srp6cl.ComputeM2()
+	if !bytes.Equal(M2, s4.M2) {
+		err = newEx(AuthFailedException, "srp6a M2 not equal")
+		goto done
 	}
+	con.peerRekey = s4.Rekey
+	con.peerCompress = s4.Compress
+	con.peerMaxMessage = s4.MaxMsg
+	con.peerMaxFragmented = s4.MaxFrag
+	con.peerBatch = s4.Batch
+
+	con.cipher, err = newXicCipher(String2CipherSuite(s4.Cipher), srp6cl.ComputeK(), false)
+done:
+	if err != nil {
+		con.set_error(err)
+		return false
+	}
+	return true
+}
+
+func (con *_Connection) client_psk(id, pass string) bool {
+	var err error
+	var p1 _P1Args
+	var p2 _P2Args
+	var p3 _P3Args
+	var p4 _P4Args
+	p1.I = id
+	p1.N = make([]byte, pskNonceSize)
+	if _, err = crand.Read(p1.N); err != nil {
+		goto done
+	}
+	if !con.check_send(ck_PSK1, &p1) {
+		return false
+	}
+
+	if !con.check_expect(ck_PSK2, &p2) {
+		return false
+	}
+	if len(p2.N) != pskNonceSize {
+		err = newEx(AuthFailedException, "Invalid psk nonce")
+		goto done
+	}
+
+	p3.M1 = pskProof(pass, "M1", id, p1.N, p2.N, nil)
+	p3.Rekey = true
+	p3.Compress = true
+	p3.MaxMsg = con.maxMessageSize
+	p3.MaxFrag = con.maxFragmentedSize
+	p3.Batch = true
+	if !con.check_send(ck_PSK3, &p3) {
+		return false
+	}
+
+	if !con.check_expect(ck_PSK4, &p4) {
+		return false
+	}
+
+	if !hmac.Equal(pskProof(pass, "M2", id, p1.N, p2.N, p3.M1), p4.M2) {
+		err = newEx(AuthFailedException, "psk M2 not equal")
+		goto done
+	}
+	con.peerRekey = p4.Rekey
+	con.peerCompress = p4.Compress
+	con.peerMaxMessage = p4.MaxMsg
+	con.peerMaxFragmented = p4.MaxFrag
+	con.peerBatch = p4.Batch
+
+	con.cipher, err = newXicCipher(String2CipherSuite(p4.Cipher), pskSessionKey(pass, id, p1.N, p2.N), false)
 done:
 	if err != nil {
 		con.set_error(err)
@@ -524,6 +967,7 @@ done:
 
 func (con *_Connection) server_run() {
 	if !con.server_handshake() {
+		con.engine.metrics.handshakeFailures.Inc()
 		con.close_and_reply(true)
 		return
 	}
@@ -547,6 +991,7 @@ func (con *_Connection) client_run() {
 	ei := con.endpoint
 	netc, err := net.DialTimeout(ei.proto, ei.Address(), con.connectTimeout)
 	if err != nil {
+		con.engine.refreshResolver(con.service)
 		con.set_error(err)
 		con.close_and_reply(true)
 		return
@@ -554,6 +999,7 @@ func (con *_Connection) client_run() {
 
 	con.c = netc
 	if !con.client_handshake() {
+		con.engine.metrics.handshakeFailures.Inc()
 		con.close_and_reply(true)
 		return
 	}
@@ -597,8 +1043,34 @@ func (con *_Connection) handleQuest(adapter Adapter, quest *_InQuest) {
 	var answer *_OutAnswer
 	var si *ServantInfo
 
+	reqEntry, first := con.engine.reqCache.start(quest, con.reqScope())
+	for reqEntry != nil && !first {
+		if con.answerDuplicate(quest, reqEntry) {
+			con.engine.numQ.Add(-1)
+			return
+		}
+		reqEntry, first = con.engine.reqCache.start(quest, con.reqScope())
+	}
+	delete(quest.ctx, "XIC_REQID")
+
+	start := time.Now()
+	rec := con.startRecord(quest, start)
+	span := con.startServerSpan(quest)
+	fault := con.engine.injectFault(quest)
 	cli_oneway := quest.txid == 0
 	srv_oneway := false
+	srv_stream := false
+	served := false		// the answer is produced by the servant
+
+	if fault != nil {
+		if fault.delay > 0 {
+			time.Sleep(fault.delay)
+		}
+		if fault.exception != nil {
+			err = fault.exception
+			goto wrong
+		}
+	}
 
 	if quest.service == "\x00" {
 		si = con.engine.keeper
@@ -609,7 +1081,7 @@ func (con *_Connection) handleQuest(adapter Adapter, quest *_InQuest) {
 		} else {
 			si = adapter.FindServant(quest.service)
 			if si == nil {
-				si := adapter.DefaultServant()
+				si = adapter.DefaultServant()
 				if si == nil {
 					err = newExf(ServiceNotFoundException, "service=%#v", quest.service)
 					goto wrong
@@ -632,12 +1104,33 @@ func (con *_Connection) handleQuest(adapter Adapter, quest *_InQuest) {
 
 		cur := newCurrent(con, quest)
 		if srv_oneway {
+			served = true
 			mi.Method.Func.Call([]reflect.Value{reflect.ValueOf(si.Servant), reflect.ValueOf(cur), in})
+		} else if mi.Stream {
+			srv_stream = true
+			if cli_oneway {
+				err = newExf(InvalidParameterException, "Streaming method %#v invoked as oneway", quest.method)
+				goto wrong
+			}
+			st, e := con.newServerStream(quest)
+			if e != nil {
+				err = e
+				goto wrong
+			}
+			served = true
+			rts := mi.Method.Func.Call([]reflect.Value{reflect.ValueOf(si.Servant), reflect.ValueOf(cur), in, reflect.ValueOf(st)})
+			con.endServerStream(st)
+			if !rts[0].IsNil() {
+				err = rts[0].Interface().(error)
+				goto wrong
+			}
+			answer = newOutAnswerNormal(quest.txid, struct{}{})
 		} else {
 			out := makePointerValue(mi.OutType)
 			if mi.OutType.Kind() != reflect.Pointer {
 				out = out.Elem()
 			}
+			served = true
 			rts := mi.Method.Func.Call([]reflect.Value{reflect.ValueOf(si.Servant), reflect.ValueOf(cur), in, out})
 			if !rts[0].IsNil() {
 				err = rts[0].Interface().(error)
@@ -664,6 +1157,7 @@ func (con *_Connection) handleQuest(adapter Adapter, quest *_InQuest) {
 			}
 
 			cur := newCurrent(con, quest)
+			served = true
 			err = si.Servant.Xic(cur, inArgs, outArgs)
 		}
 
@@ -677,12 +1171,24 @@ wrong:
 	if err != nil {
 		dlog.Log("XIC.EXCEPT", "%s::%s return error --- %s", quest.service, quest.method, err.Error())
 	}
+	span.finish(err)
+	con.engine.metrics.questServed(start, !cli_oneway, err)
+	canceled := con.endQuestContext(quest)
 
 	if cli_oneway {
+		con.finishRecord(rec, start, nil, srv_stream)
+		if served {
+			con.engine.reqCache.finish(reqEntry, nil)
+		} else {
+			con.engine.reqCache.abort(reqEntry)
+		}
 		con.numQ.Add(-1)
 		if !srv_oneway {
 			dlog.Log("XIC.WARN", "%s::%s --- Twoway method invoked as oneway, con=%v", quest.service, quest.method, con)
 		}
+		if fault != nil && fault.close {
+			con.closeForcefully()
+		}
 	} else {
 		if srv_oneway {
 			dlog.Log("XIC.WARN", "%s::%s --- Oneway method invoked as twoway, con=%v", quest.service, quest.method, con)
@@ -697,13 +1203,42 @@ wrong:
 			panic("Can't reach here")
 		}
 
-		con.sendMessage(answer)
+		answer.high = quest.high
+		con.finishRecord(rec, start, answer, srv_stream)
+		if served && !canceled {
+			con.engine.reqCache.finish(reqEntry, answer)
+		} else {
+			con.engine.reqCache.abort(reqEntry)
+		}
+		if canceled || (fault != nil && (fault.drop || fault.close)) {
+			con.dropAnswer(quest, answer)
+			if canceled {
+				dlog.Log("XIC.INFO", "%s::%s --- Quest canceled by the client, txid=%d con=%v", quest.service, quest.method, quest.txid, con)
+			} else if fault.close {
+				dlog.Log("XIC.WARN", "%s::%s --- Connection closed by injected fault, con=%v", quest.service, quest.method, con)
+				con.closeForcefully()
+			}
+		} else {
+			con.answerQuest(quest, answer)
+		}
 	}
 
 	con.engine.numQ.Add(-1)
 }
 
 func (con *_Connection) handleAnswer(answer *_InAnswer) {
+	if answer.status == answer_PARTIAL {
+		con.mutex.Lock()
+		res, ok := con.pending[answer.txid]
+		con.mutex.Unlock()
+		if !ok || res.stream == nil {
+			dlog.Log("XIC.WARN", "Unexpected partial answer with txid=%d", answer.txid)
+			return
+		}
+		res.pushPartial(answer)
+		return
+	}
+
 	con.mutex.Lock()
 	res, ok := con.pending[answer.txid]
 	if ok {
@@ -719,31 +1254,34 @@ func (con *_Connection) handleAnswer(answer *_InAnswer) {
 		return
 	}
 
+	exname := ""
 	if answer.status != 0 {
 		args := NewArguments()
 		res.err = answer.DecodeArgs(args)
 		if res.err == nil {
-			res.err = newRemoteExCode(ExNameType(args.GetString("exname")), int(args.GetInt("code")), args.GetString("message"), con)
+			exname = args.GetString("exname")
+			res.err = newRemoteExCode(ExNameType(exname), int(args.GetInt("code")), args.GetString("message"), con)
 		}
 	} else if res.out != nil {
 		res.err = answer.DecodeArgs(res.out)
 	}
+	con.engine.metrics.answerReceived(res, exname)
 
 	res.broadcast()
 }
 
-func checkHeader(header _MessageHeader) error {
+func checkHeader(header _MessageHeader, maxSize int) error {
 	if header.Magic != 'X' || header.Version != '!' {
 		return newExf(ProtocolException, "Unknown message Magic(%d) and Version(%d)", header.Magic, header.Version)
 	}
 
 	switch header.Type {
-	case QuestMsgType, AnswerMsgType, CheckMsgType:
+	case QuestMsgType, AnswerMsgType, CheckMsgType, BatchQuestMsgType, BatchAnswerMsgType:
 		if (header.Flags &^ FLAG_MASK) != 0 {
 			return newEx(ProtocolException, "Unknown message Flags")
-		} else if int(header.BodySize) > MaxMessageSize {
-			if (header.Flags & FLAG_CIPHER) == 0 || int(header.BodySize) - CipherMacSize > MaxMessageSize {
-				return newExf(ProtocolException, "Message size too large, should less than %d", MaxMessageSize)
+		} else if int(header.BodySize) > maxSize {
+			if (header.Flags & FLAG_CIPHER) == 0 || int(header.BodySize) - CipherMacSize > maxSize {
+				return newExf(ProtocolException, "Message size too large, should less than %d", maxSize)
 			}
 		}
 	case HelloMsgType, ByeMsgType:
@@ -812,10 +1350,45 @@ again:
 	return err	// DON'T xerr.Trace
 }
 
+// Append the fragment, return the whole message after the last fragment
+func (con *_Connection) reassemble(header _MessageHeader, body []byte) (_MessageHeader, []byte, bool, error) {
+	if con.fragments == nil {
+		if con.maxFragmentedSize <= 0 {
+			return header, nil, false, newEx(ProtocolException, "Fragmented message not accepted")
+		}
+		if !isQuestOrAnswer(header.Type) {
+			return header, nil, false, newExf(ProtocolException, "Fragmented message of type(%#x) not allowed", header.Type)
+		}
+		con.fragHeader = header
+		con.fragments = make([]byte, 0, 2 * len(body))
+	} else if header.Type != con.fragHeader.Type {
+		return header, nil, false, newEx(ProtocolException, "Fragments of different messages interleaved")
+	}
+
+	if len(con.fragments) + len(body) > con.maxFragmentedSize {
+		return header, nil, false, newExf(ProtocolException, "Fragmented message size too large, should less than %d", con.maxFragmentedSize)
+	}
+	con.fragments = append(con.fragments, body...)
+	if (header.Flags & FLAG_MORE) != 0 {
+		return header, nil, false, nil
+	}
+
+	header = con.fragHeader
+	body = con.fragments
+	con.fragments = nil
+	header.Flags &^= FLAG_MORE
+	header.BodySize = int32(len(body))
+	return header, body, true, nil
+}
+
 func (con *_Connection) recv_msg(must bool) (msg _Message) {
 	var err error
 	var bodybuf []byte
+	var pooled []byte	// returned to the pool unless owned by the message
 	var headbuf [MsgHeaderSize]byte
+	var header _MessageHeader
+	complete := false
+next:
 	if err = con._read_header(headbuf[:], must); err != nil {
 		if err == io.EOF {
 			con.mutex.Lock()
@@ -836,17 +1409,20 @@ func (con *_Connection) recv_msg(must bool) (msg _Message) {
 		return
 	}
 
-	header := buf2header(headbuf[:])
-	if err = checkHeader(header); err != nil {
+	con.engine.metrics.bytesReceived.Add(MsgHeaderSize)
+	header = buf2header(headbuf[:])
+	if err = checkHeader(header, con.maxMessageSize); err != nil {
 		dlog.Log("XIC.WARN", "Invalid xic header %v", header)
 		goto done
 	}
 
 	if header.BodySize > 0 {
-		bodybuf = make([]byte, header.BodySize)
+		bodybuf = getInBuffer(int(header.BodySize))
+		pooled = bodybuf
 		if _, err = io.ReadFull(con.c, bodybuf); err != nil {
 			goto done
 		}
+		con.engine.metrics.bytesReceived.Add(int64(header.BodySize))
 	}
 
 	if (header.Flags & FLAG_CIPHER) != 0 {
@@ -869,8 +1445,45 @@ func (con *_Connection) recv_msg(must bool) (msg _Message) {
 		bodybuf = bodybuf[:header.BodySize]
 	}
 
-	msg, err = DecodeMessage(header, bodybuf)
+	if (header.Flags & FLAG_MORE) != 0 || con.fragments != nil {
+		header, bodybuf, complete, err = con.reassemble(header, bodybuf)
+		// The fragment is copied
+		putInBuffer(pooled)
+		pooled = nil
+		if err != nil {
+			goto done
+		} else if !complete {
+			// The following fragments are part of this message
+			must = true
+			goto next
+		}
+	}
+
+	if (header.Flags & FLAG_COMPRESS) != 0 {
+		// decrypt and reassemble before decompress
+		limit := con.maxMessageSize
+		if limit < con.maxFragmentedSize {
+			limit = con.maxFragmentedSize
+		}
+		if bodybuf, err = decompressBody(bodybuf, limit); err != nil {
+			goto done
+		}
+		header.BodySize = int32(len(bodybuf))
+		putInBuffer(pooled)
+		pooled = nil
+	}
+
+	msg, err = decodeMessage(header, bodybuf, pooled != nil)
+	if err == nil {
+		pooled = nil
+		if c, ok := msg.(*_InCheck); ok {
+			c.encrypted = (header.Flags & FLAG_CIPHER) != 0
+		}
+	}
 done:
+	if pooled != nil {
+		putInBuffer(pooled)
+	}
 	if err != nil {
 		con.set_error(err)
 	}
@@ -885,32 +1498,156 @@ func (con *_Connection) try_read_msg() _Message {
 	return con.recv_msg(false)
 }
 
+// Write the message immediately
 func (con *_Connection) send_msg(msg _OutMessage) error {
-	var mac [CipherMacSize]byte
-	encrypted := false
-	cipher := con.cipher
+	con.buffer_msg(msg)
+	return con.flush()
+}
 
-	buf := msg.Bytes()
-	msgType := msg.Type()
-	if cipher != nil && (msgType == QuestMsgType || msgType == AnswerMsgType) {
-		encrypted = true
+// The maximum body size of a message the peer can receive, 0 if unknown.
+// The peer announces its limits only during the authentication, so the
+// limits of the peer without authentication are unknown.
+func (con *_Connection) peerMaxSize() int {
+	size := con.peerMaxMessage
+	if size > 0 && size < con.peerMaxFragmented {
+		size = con.peerMaxFragmented
+	}
+	return size
+}
+
+// The quest larger than the peer can receive would make the peer close
+// the connection, so it is failed alone instead of sent.
+// Called after the connection is active, when the limits of peer are known.
+func (con *_Connection) check_size(q *_OutQuest) error {
+	limit := con.peerMaxSize()
+	if limit > 0 {
+		if size := len(q.Bytes()) - MsgHeaderSize; size > limit {
+			return newExf(MessageSizeException, "Quest size %d exceeds the maximum %d of the peer", size, limit)
+		}
+	}
+	return nil
+}
+
+// Fail the quest that is not sent, see check_size()
+func (con *_Connection) reject_quest(q *_OutQuest, err error) {
+	var res *_Result
+	if q.txid != 0 {
+		con.mutex.Lock()
+		res = con.pending[q.txid]
+		delete(con.pending, q.txid)
+		if con.byebye_ok() {
+			con.cond.Broadcast()
+		}
+		con.mutex.Unlock()
+	}
+	if res != nil {
+		res.err = err
+		res.broadcast()
+	} else {
+		dlog.Log("XIC.WARN", "Oneway quest not sent: %v", err)
+	}
+}
+
+// Append the message to the write buffers, see buffer_frame()
+func (con *_Connection) buffer_msg(msg _OutMessage) {
+	if b, ok := msg.(*_OutBatch); ok && b.quests != nil {
+		con.buffer_batch(b)
+		return
+	}
+	con.buffer_bytes(msg.Bytes(), msg.Type())
+}
+
+// Compress and fragment the quest or answer if necessary
+func (con *_Connection) buffer_bytes(buf []byte, msgType MsgType) {
+	if isQuestOrAnswer(msgType) {
+		threshold := con.engine.compressThreshold
+		if con.peerCompress && threshold > 0 && len(buf) - MsgHeaderSize > threshold {
+			// compress before fragment and encrypt
+			if cbuf := compressMessage(buf); cbuf != nil {
+				buf = cbuf
+			}
+		}
+
+		if con.peerMaxFragmented > 0 && con.peerMaxMessage > 0 && len(buf) - MsgHeaderSize > con.peerMaxMessage {
+			con.buffer_fragments(buf, con.peerMaxMessage)
+			return
+		}
+	}
+	con.buffer_frame(buf, msgType)
+}
+
+// Split the message into fragments no larger than the peer accepts
+func (con *_Connection) buffer_fragments(buf []byte, size int) {
+	hdr := buf2header(buf[:MsgHeaderSize])
+	body := buf[MsgHeaderSize:]
+	for len(body) > 0 {
+		n := len(body)
+		fhdr := hdr
+		if n > size {
+			n = size
+			fhdr.Flags |= FLAG_MORE
+		}
+		fhdr.BodySize = int32(n)
+
+		frame := make([]byte, MsgHeaderSize + n)
+		fhdr.FillBuffer(frame[:MsgHeaderSize])
+		copy(frame[MsgHeaderSize:], body[:n])
+		con.buffer_frame(frame, hdr.Type)
+		body = body[n:]
+	}
+}
+
+// Called only by the writer of the connection.
+// The frame is encrypted (in place) when appended, so the frames must be
+// appended in the order of sending, and buf can't be changed until flush().
+// The check messages after the authentication (e.g. REKEY) are encrypted
+// too, so they can't be forged, see handleCheck().
+func (con *_Connection) buffer_frame(buf []byte, msgType MsgType) {
+	con.wbufs = append(con.wbufs, buf)
+	con.wsize += len(buf)
+
+	cipher := con.cipher
+	if cipher != nil && (isQuestOrAnswer(msgType) || msgType == CheckMsgType) {
 		hdr := buf2header(buf[:MsgHeaderSize])
-		hdr.Flags = FLAG_CIPHER
+		hdr.Flags |= FLAG_CIPHER
 		hdr.BodySize += CipherMacSize
 		hdr.FillBuffer(buf[:MsgHeaderSize])
 
 		cipher.OutputStart(buf[:MsgHeaderSize])
 		cipher.OutputUpdate(buf[MsgHeaderSize:], buf[MsgHeaderSize:])
-		cipher.OutputFinish(mac[:])
+
+		// The MACs of the buffered frames share con.macs
+		k := len(con.macs)
+		if cap(con.macs) - k < CipherMacSize {
+			macs := make([]byte, k, 2 * cap(con.macs) + CipherMacSize * 16)
+			copy(macs, con.macs)
+			con.macs = macs
+		}
+		con.macs = con.macs[:k + CipherMacSize]
+		mac := con.macs[k:k + CipherMacSize:k + CipherMacSize]
+		cipher.OutputFinish(mac)
+		con.wbufs = append(con.wbufs, mac)
+		con.wsize += CipherMacSize
+	}
+}
+
+// Write all the buffered frames with one writev(2) if supported
+func (con *_Connection) flush() error {
+	if len(con.wbufs) == 0 {
+		return nil
 	}
 
 	con.c.SetWriteDeadline(con._deadline())
-	_, err := con.c.Write(buf)
-	if err == nil {
-		if encrypted {
-			_, err = con.c.Write(mac[:])
-		}
+	bufs := con.wbufs
+	n, err := bufs.WriteTo(con.c)
+	con.engine.metrics.bytesSent.Add(n)
+
+	for i := range con.wbufs {
+		con.wbufs[i] = nil
 	}
+	con.wbufs = con.wbufs[:0]
+	con.wsize = 0
+	con.macs = con.macs[:0]
 
 	if err != nil {
 		return xerr.Tracef(err, "Connection write error, con=%s", con.String())
@@ -918,6 +1655,12 @@ func (con *_Connection) send_msg(msg _OutMessage) error {
 	return nil
 }
 
+// Limits of the frames coalesced into one write
+const (
+	_MAX_WRITE_BUFFERS = 64
+	_MAX_WRITE_SIZE = 256 * 1024
+)
+
 func (con *_Connection) sendMessage(msg _OutMessage) {
 	// msg.Type() == AnswerMsgType || msg.Type() == QuestMsgType
 	con.mutex.Lock()
@@ -934,6 +1677,7 @@ func (con *_Connection) byebye_ok() bool {
 
 func (con *_Connection) send_loop() {
 	var err error
+	var written []_OutMessage	// the buffered messages, released after flush()
 	for {
 		con.mutex.Lock()
 		for con.mq.Num() == 0 && con.state <= con_CLOSING && !con.byebye_ok() {
@@ -953,22 +1697,53 @@ func (con *_Connection) send_loop() {
 			goto done
 		}
 
+		// Coalesce the queued messages into one write
 		for {
 			con.mutex.Lock()
 			msg := con.mq.PopFront()
+			more := con.mq.Num() > 0
+			if msg != nil && con.queueWaiters > 0 {
+				con.cond.Broadcast()
+			}
 			con.mutex.Unlock()
 			if msg == nil {
 				break
 			}
 
-			err = con.send_msg(msg)
+			err = con.check_rekey()
 			if err != nil {
 				goto done
 			}
-			if msg.Type() == AnswerMsgType {
+
+			if q, ok := msg.(*_OutQuest); ok {
+				if e := con.check_size(q); e != nil {
+					con.reject_quest(q, e)
+					q.release()
+					continue
+				}
+			}
+
+			con.buffer_msg(msg)
+			written = append(written, msg)
+			if a, ok := msg.(*_OutAnswer); ok && !a.partial {
 				con.numQ.Add(-1)
+			} else if b, ok := msg.(*_OutBatch); ok && b.quests == nil {
+				con.numQ.Add(-int32(b.num))
 			}
+
+			if !more || len(con.wbufs) >= _MAX_WRITE_BUFFERS || con.wsize >= _MAX_WRITE_SIZE {
+				if err = con.flush(); err != nil {
+					goto done
+				}
+				written = releaseMessages(written)
+			}
+		}
+
+		// The queue may be cleared when closing
+		if err = con.flush(); err != nil {
+			goto done
 		}
+		written = releaseMessages(written)
 	}
 done:
 	if err != nil {
@@ -976,14 +1751,78 @@ done:
 	}
 }
 
+// Called only in the send_loop goroutine.
+// The REKEY check message is encrypted with the current key, and all the
+// messages after it are encrypted with the new key.
+func (con *_Connection) check_rekey() error {
+	cipher := con.cipher
+	engine := con.engine
+	if cipher == nil || !con.peerRekey {
+		return nil
+	}
+
+	if (engine.rekeyMessages > 0 && cipher.oCount >= engine.rekeyMessages) ||
+		(engine.rekeyInterval > 0 && time.Since(cipher.oTime) >= engine.rekeyInterval) {
+		epoch := cipher.oEpoch.Load() + 1
+		con.buffer_msg(newOutCheck(ck_REKEY, &_RekeyArgs{Epoch:epoch}))
+		if err := cipher.RekeyOutput(epoch); err != nil {
+			return err
+		}
+		dlog.Log("XIC.INFO", "Rekeyed outgoing direction, epoch=%d con=%s", epoch, con.String())
+	}
+	return nil
+}
+
+// Called only in the process_loop goroutine.
+// Unknown check commands are ignored.
+// The check messages in clear text are refused if a cipher negotiated.
+func (con *_Connection) handleCheck(check *_InCheck) error {
+	if con.cipher != nil && !check.encrypted {
+		return newExf(ProtocolException, "Check message %#v not encrypted", check.cmd)
+	}
+	switch check.cmd {
+	case ck_REKEY:
+		var args _RekeyArgs
+		if err := check.DecodeArgs(&args); err != nil {
+			return err
+		}
+		if con.cipher == nil {
+			return newEx(ProtocolException, "REKEY received but no cipher negotiated")
+		}
+		if err := con.cipher.RekeyInput(args.Epoch); err != nil {
+			return newEx(ProtocolException, err.Error())
+		}
+	case ck_CREDIT:
+		var args _CreditArgs
+		if err := check.DecodeArgs(&args); err != nil {
+			return err
+		}
+		con.addStreamCredit(args.Txid, args.Num)
+	case ck_CANCEL:
+		var args _CancelArgs
+		if err := check.DecodeArgs(&args); err != nil {
+			return err
+		}
+		con.cancelQuest(args.Txid)
+	default:
+		dlog.Log("XIC.WARN", "Unknown check command %#v ignored, con=%s", check.cmd, con.String())
+	}
+	return nil
+}
+
 func (con *_Connection) check_doable(quest *_InQuest) bool {
 	var err error
 	doit := false
 	engine := con.engine
 
+	quest.high = engine.questHighPriority(quest)
+	privileged := engine.questPrivileged(quest)
 	con.mutex.Lock()
-	if con.state == con_ACTIVE {
-		if con.maxQ > 0 && con.numQ.Load() >= con.maxQ {
+	active := con.state == con_ACTIVE
+	if active {
+		if privileged {
+			doit = true
+		} else if con.maxQ > 0 && con.numQ.Load() >= con.maxQ {
 			err = newException(ConnectionOverloadException)
 		} else if engine.numQ.Load() >= engine.maxQ {
 			err = newException(ConnectionOverloadException)
@@ -995,6 +1834,14 @@ func (con *_Connection) check_doable(quest *_InQuest) bool {
 	}
 	con.mutex.Unlock()
 
+	if !active {
+		if quest.batch != nil {
+			// Not answered, but the other answers of the batch wait for it
+			quest.batch.add(con, nil)
+		}
+		return false
+	}
+
 	if doit {
 		if len(quest.service) == 0 {
 			err = newEx(ServiceNotFoundException, "service=\"\"")
@@ -1011,7 +1858,7 @@ func (con *_Connection) check_doable(quest *_InQuest) bool {
 			con.numQ.Add(-1)
 		} else {
 			answer := err2OutAnswer(quest, err)
-			con.sendMessage(answer)
+			con.answerQuest(quest, answer)
 		}
 		engine.numQ.Add(-1)
 		return false
@@ -1036,15 +1883,28 @@ func (con *_Connection) process_loop() {
 		case QuestMsgType:
 			quest := msg.(*_InQuest)
 			if con.check_doable(quest) {
-				adp := con.adapter.Load()
-				adapter := adp.(Adapter)
-				go con.handleQuest(adapter, quest)
+				con.startQuestContext(quest)
+				go con.handleQuest(con.Adapter(), quest)
 			}
 
 		case AnswerMsgType:
 			answer := msg.(*_InAnswer)
 			con.handleAnswer(answer)
 
+		case BatchQuestMsgType:
+			con.handleBatch(msg.(*_InBatch))
+
+		case BatchAnswerMsgType:
+			for _, item := range msg.(*_InBatch).items {
+				con.handleAnswer(newInAnswer(item, false))
+			}
+
+		case CheckMsgType:
+			err = con.handleCheck(msg.(*_InCheck))
+			if err != nil {
+				goto done
+			}
+
 		case ByeMsgType:
 			con.mutex.Lock()
 			state := con.state
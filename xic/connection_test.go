@@ -0,0 +1,286 @@
+package xic
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutMsgQueue(t *testing.T) {
+	var q OutMsgQueue
+	if q.PopFront() != nil {
+		t.Fatalf("Bug in OutMsgQueue.PopFront() of empty queue")
+	}
+
+	msgs := make([]_OutMessage, 100)
+	size := 0
+	for i := range msgs {
+		msgs[i] = newOutQuest(int64(i+1), "Demo", "echo", Context{}, map[string]any{"i":i})
+		size += len(msgs[i].Bytes())
+	}
+
+	// Wrap around the ring before growing
+	for _, m := range msgs[:10] {
+		q.PushBack(m)
+	}
+	for _, m := range msgs[:10] {
+		if q.PopFront() != m {
+			t.Fatalf("Wrong order of OutMsgQueue")
+		}
+	}
+	for _, m := range msgs {
+		q.PushBack(m)
+	}
+	if q.Num() != len(msgs) || q.Bytes() != size {
+		t.Fatalf("Wrong OutMsgQueue num=%d bytes=%d", q.Num(), q.Bytes())
+	}
+
+	for i, m := range msgs {
+		if q.PopFront() != m {
+			t.Fatalf("Wrong order of OutMsgQueue at %d", i)
+		}
+		if i == 49 {
+			q.PushBack(msgs[0])
+		}
+	}
+	if q.PopFront() != msgs[0] || q.Num() != 0 || q.Bytes() != 0 {
+		t.Fatalf("Bug in OutMsgQueue")
+	}
+
+	q.PushBack(msgs[1])
+	q.Clear()
+	if q.Num() != 0 || q.Bytes() != 0 || q.PopFront() != nil {
+		t.Fatalf("Bug in OutMsgQueue.Clear()")
+	}
+}
+
+func TestWaitQueue(t *testing.T) {
+	setting := NewSetting()
+	setting.Set("xic.queue.messages", "1")
+	setting.Set("xic.queue.block", "true")
+	engine := newEngineSetting(setting)
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+	con := _newConnection(engine, false)
+	con.timeout = time.Millisecond * 50
+	con.mq.PushBack(newOutQuest(0, "Demo", "echo", Context{}, struct{}{}))
+
+	// Blocked until timeout
+	start := time.Now()
+	res := &_Result{}
+	err := con.invoke(nil, newOutQuest(-1, "Demo", "echo", Context{}, struct{}{}), res)
+	ex, ok := err.(Exception)
+	if !ok || ex.Name() != ConnectionOverloadException || res.err != err {
+		t.Fatalf("Invoke with full queue should fail with ConnectionOverloadException: %v", err)
+	}
+	if d := time.Since(start); d < con.timeout || d > con.timeout * 10 {
+		t.Errorf("Invoke blocked for %v with timeout %v", d, con.timeout)
+	}
+
+	// Woken up when there is room in the queue
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		con.mutex.Lock()
+		con.mq.PopFront()
+		con.cond.Broadcast()
+		con.mutex.Unlock()
+	}()
+	if err = con.invoke(nil, newOutQuest(-1, "Demo", "echo", Context{}, struct{}{}), &_Result{}); err != nil {
+		t.Fatalf("Invoke should succeed after the queue drained: %v", err)
+	}
+}
+
+func TestPskHandshake(t *testing.T) {
+	ss := NewSetting()
+	ss.Set("xic.passport.auth", "PSK")
+	for _, pass := range []string{"world", "wrong"} {
+		srv, cli, _, endpoint := startTestEngines(t, false, ss, nil)
+		sb, _ := NewSecretBox("@++ = hello:world")
+		srv.SetSecretBox(sb)
+		cb, _ := NewSecretBox("@++ = hello:" + pass)
+		cli.SetSecretBox(cb)
+
+		prx, _ := cli.StringToProxy("Bench" + endpoint)
+		var out _BenchArgs
+		err := prx.Invoke("echo", _BenchArgs{Seq:1}, &out)
+		if pass == "world" {
+			if err != nil {
+				t.Errorf("PSK handshake failed: %v", err)
+			} else if cons := cli.getAllConnections(); len(cons) != 1 || cons[0].cipher == nil || out.Seq != 1 {
+				t.Errorf("PSK connection not encrypted")
+			}
+		} else if err == nil {
+			t.Errorf("PSK handshake should fail with wrong password")
+		}
+		stopTestEngines(srv, cli)
+	}
+}
+
+// Call back the client through the connection of the quest
+type _CallerServant struct {
+	DefaultServant
+}
+
+func (s *_CallerServant) Xic_call(cur Current, in struct{}, out *_NameArgs) error {
+	prx, err := cur.CallbackProxy("Name")
+	if err != nil {
+		return err
+	}
+	return prx.Invoke("name", nil, out)
+}
+
+func TestCallback(t *testing.T) {
+	srv, cli, adapter, endpoint := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv, cli)
+	adapter.MustAddServant("Caller", &_CallerServant{})
+
+	slack, err := cli.CreateSlackAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slack.MustAddServant("Name", &_NameServant{name:"client"})
+	slack.Activate()
+
+	prx, _ := cli.StringToProxy("Caller" + endpoint)
+	var out _NameArgs
+	if err = prx.Invoke("call", nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "client" {
+		t.Errorf("Callback answered by %#v", out.Name)
+	}
+}
+
+type _BenchServant struct {
+	DefaultServant
+}
+
+func TestMessageSize(t *testing.T) {
+	setting := NewSetting()
+	setting.Set("test.MaxMessageSize", "1000")
+	srv, cli, _, endpoint := startTestEngines(t, true, setting, nil)
+	defer stopTestEngines(srv, cli)
+	prx, _ := cli.StringToProxy("Bench" + endpoint)
+
+	isSizeEx := func(err error) bool {
+		ex, ok := err.(Exception)
+		return ok && !ex.IsRemote() && ex.Name() == MessageSizeException
+	}
+
+	// Queued before the connection is active
+	big := _BenchArgs{Data:make([]byte, 2000)}
+	if err := prx.Invoke("echo", big, nil); !isSizeEx(err) {
+		t.Fatalf("Invoke with large quest should fail with MessageSizeException: %v", err)
+	}
+
+	var out _BenchArgs
+	if err := prx.Invoke("echo", _BenchArgs{Seq:1}, &out); err != nil || out.Seq != 1 {
+		t.Fatalf("Invoke failed after the large quest: %v", err)
+	}
+	if err := prx.Invoke("echo", big, nil); !isSizeEx(err) {
+		t.Fatalf("Invoke with large quest should fail with MessageSizeException: %v", err)
+	}
+	if err := prx.Invoke("echo", _BenchArgs{Seq:2}, &out); err != nil || out.Seq != 2 {
+		t.Fatalf("Invoke failed after the large quest: %v", err)
+	}
+}
+
+type _BenchArgs struct {
+	Seq int		`vbs:"seq"`
+	Data []byte	`vbs:"data"`
+}
+
+func (s *_BenchServant) Xic_echo(cur Current, in _BenchArgs, out *_BenchArgs) error {
+	*out = in
+	return nil
+}
+
+// Start a server engine and a client engine connected through the loopback.
+// The adapter of the server serves the Bench servant at endpoint.
+// The settings may be nil.
+func startTestEngines(tb testing.TB, auth bool, srvSetting, cliSetting Setting) (srv, cli *_Engine, adapter Adapter, endpoint string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	endpoint = fmt.Sprintf("@tcp+127.0.0.1+%d", port)
+
+	if srvSetting == nil {
+		srvSetting = NewSetting()
+	}
+	srv = newEngineSetting(srvSetting)
+	if auth {
+		sb, err := NewShadowBox(shadow)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		srv.SetShadowBox(sb)
+	}
+	adapter, err = srv.CreateAdapterEndpoints("test", endpoint)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	adapter.MustAddServant("Bench", &_BenchServant{})
+	adapter.Activate()
+
+	if cliSetting == nil {
+		cliSetting = NewSetting()
+	}
+	cli = newEngineSetting(cliSetting)
+	sec, _ := NewSecretBox(secret)
+	cli.SetSecretBox(sec)
+	return
+}
+
+func startBenchEngines(b *testing.B, auth bool) (srv, cli *_Engine, prx Proxy) {
+	srv, cli, _, endpoint := startTestEngines(b, auth, nil, nil)
+	prx, err := cli.StringToProxy("Bench" + endpoint)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = prx.Invoke("echo", _BenchArgs{}, nil); err != nil {
+		b.Fatal(err)
+	}
+	return
+}
+
+func stopTestEngines(srv, cli *_Engine) {
+	cli.Shutdown()
+	srv.Shutdown()
+	cli.WaitForShutdown()
+	srv.WaitForShutdown()
+}
+
+func benchmarkInvoke(b *testing.B, auth bool) {
+	srv, cli, prx := startBenchEngines(b, auth)
+	defer stopTestEngines(srv, cli)
+
+	data := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var out _BenchArgs
+		for i := 0; pb.Next(); i++ {
+			if err := prx.Invoke("echo", _BenchArgs{Seq:i, Data:data}, &out); err != nil {
+				b.Error(err)
+				return
+			}
+			if out.Seq != i {
+				b.Errorf("Wrong answer %d, should be %d", out.Seq, i)
+				return
+			}
+		}
+	})
+}
+
+// Small quests sent concurrently through one connection
+func BenchmarkInvokeParallel(b *testing.B) {
+	benchmarkInvoke(b, false)
+}
+
+func BenchmarkInvokeParallelCipher(b *testing.B) {
+	benchmarkInvoke(b, true)
+}
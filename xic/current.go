@@ -15,3 +15,25 @@ func (cur *_Current) Method() string	{ return cur.method }
 func (cur *_Current) Ctx() Context	{ return cur.ctx }
 func (cur *_Current) Con() Connection	{ return cur.con }
 
+func (cur *_Current) CallbackProxy(service string) (Proxy, error) {
+	return cur.con.CreateFixedProxy(service)
+}
+
+
+func (cur *_Current) TracedProxy(prx Proxy) Proxy {
+	trace := cur.TraceContext()
+	if len(trace) == 0 {
+		return prx
+	}
+	return &_TracedProxy{Proxy: prx, trace: trace}
+}
+
+func (cur *_Current) TraceContext() Context {
+	ctx := NewContext()
+	for _, k := range []string{"XIC_TRACE", "XIC_SPAN", "XIC_SAMPLED"} {
+		if v, ok := cur.ctx[k]; ok {
+			ctx[k] = v
+		}
+	}
+	return ctx
+}
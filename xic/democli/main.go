@@ -8,6 +8,30 @@ import (
 	"halftwo/mangos/xic"
 )
 
+type _CallbackServant struct {
+	xic.DefaultServant
+}
+
+type _CallbackTimes struct {
+	Ctime string `vbs:"ctime"`
+}
+
+type _CallbackTimeOutArgs struct {
+	Con string `vbs:"con"`
+	Time int64 `vbs:"time"`
+	Strftime _CallbackTimes `vbs:"strftime"`
+}
+
+// Invoked by the server through the connection to it
+func (srv *_CallbackServant) Xic_cb_time(cur xic.Current, in struct{}, out *_CallbackTimeOutArgs) error {
+	t := time.Now()
+	out.Con = cur.Con().String()
+	out.Time = t.Unix()
+	out.Strftime.Ctime = t.Format(time.ANSIC)
+	fmt.Println("Callback cb_time invoked through", out.Con)
+	return nil
+}
+
 func run_xic(engine xic.Engine, args []string) error {
 	secretBox, err := xic.NewSecretBox("@++=hello:world")
 	if err != nil {
@@ -29,6 +53,17 @@ func run_xic(engine xic.Engine, args []string) error {
 		return err
 	}
 
+	slack, err := engine.CreateSlackAdapter()
+	if err != nil {
+		return err
+	}
+	slack.MustAddServant("DemoCallback", &_CallbackServant{})
+
+	callback := xic.NewArguments()
+	callback.Set("callback", "DemoCallback")
+	err = prx.Invoke("setCallback", callback, nil)
+	fmt.Println(err)
+
 	type EchoAnswer struct {
 		A float32 `vbs:"参数1"`
 		B string `vbs:"参数2"`
@@ -67,7 +102,7 @@ func run_xic(engine xic.Engine, args []string) error {
 
 func main() {
 	start := time.Now()
-	xic.Run(run)
+	xic.Run(run_xic)
 	fmt.Println("Time elapsed:", float32(time.Now().Sub(start))/float32(time.Second))
 }
 
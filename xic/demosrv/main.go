@@ -57,6 +57,29 @@ func (srv *_DemoServant) Xic_time(cur xic.Current, in _TimeInArgs, out *_TimeOut
 	return nil
 }
 
+type _SetCallbackInArgs struct {
+	Callback string `vbs:"callback"`
+}
+
+// Invoke the callback servant of the client through the same connection
+func (srv *_DemoServant) Xic_setCallback(cur xic.Current, in _SetCallbackInArgs, out *xic.Arguments) error {
+	prx, err := cur.CallbackProxy(in.Callback)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		answer := xic.NewArguments()
+		err := prx.Invoke("cb_time", nil, answer)
+		if err != nil {
+			dlog.Log("DEMO.WARN", "Failed to invoke callback %s: %s", prx.String(), err.Error())
+			return
+		}
+		dlog.Log("DEMO.INFO", "Callback %s answered %v", prx.String(), answer)
+	}()
+	return nil
+}
+
 func throb() string {
 	return "this is demosrv"
 }
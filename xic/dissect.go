@@ -0,0 +1,206 @@
+package xic
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"halftwo/mangos/xerr"
+)
+
+/*
+   Dissector decodes the xic frames in a captured byte stream of one
+   direction of a connection, e.g. the TCP payload extracted from a pcap
+   file. See cmd/xicdump.
+
+   The bytes not beginning a valid frame header are skipped. The fragments
+   are reassembled and the compressed bodies are decompressed before the
+   messages decoded. The bodies of the encrypted frames can't be decoded.
+*/
+type Dissector struct {
+	MaxSize int		// the maximum size of a frame or a reassembled message, MaxMessageSize by default
+	r *bufio.Reader
+	offset int64
+	fragHeader _MessageHeader
+	fragments []byte
+}
+
+// Frame is a frame decoded by the Dissector
+type Frame struct {
+	Offset   int64		// the offset of the frame in the stream
+	Skipped  int		// the number of bytes skipped before the frame
+	Magic    byte
+	Version  byte
+	Type     MsgType
+	Flags    byte
+	BodySize int
+
+	// Set if the message is decoded, which means the frame is not
+	// encrypted and is not followed by more fragments.
+	Decoded  bool
+	Txid     int64		// of the quest or the answer, 0 for oneway quest
+	Service  string		// of the quest
+	Method   string		// of the quest
+	Ctx      Context	// of the quest
+	Status   int		// of the answer, 0 for normal, -1 for exception, 1 for partial
+	Cmd      string		// of the check message
+	Args     Arguments
+	Items    []*Frame	// the quests or answers of the batch message
+	Err      error		// the error of decoding the message
+}
+
+func (f *Frame) Encrypted() bool {
+	return (f.Flags & FLAG_CIPHER) != 0
+}
+
+func (f *Frame) Compressed() bool {
+	return (f.Flags & FLAG_COMPRESS) != 0
+}
+
+func (f *Frame) More() bool {
+	return (f.Flags & FLAG_MORE) != 0
+}
+
+// Return the names of the flags joined with "|", or "0" if no flags set
+func (f *Frame) FlagsString() string {
+	var names []string
+	if f.Encrypted() {
+		names = append(names, "CIPHER")
+	}
+	if f.Compressed() {
+		names = append(names, "COMPRESS")
+	}
+	if f.More() {
+		names = append(names, "MORE")
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+func NewDissector(r io.Reader) *Dissector {
+	return &Dissector{MaxSize:MaxMessageSize, r:bufio.NewReader(r)}
+}
+
+// Return io.EOF after the last frame
+func (d *Dissector) Next() (*Frame, error) {
+	f := &Frame{}
+	var header _MessageHeader
+	for {
+		head, err := d.r.Peek(MsgHeaderSize)
+		if err != nil {
+			if len(head) == 0 && f.Skipped == 0 {
+				return nil, io.EOF
+			}
+			return nil, xerr.Errorf("Truncated stream, %d bytes left at offset %d", f.Skipped + len(head), d.offset - int64(f.Skipped))
+		}
+		header = buf2header(head)
+		if checkHeader(header, d.MaxSize) == nil {
+			break
+		}
+		d.r.Discard(1)
+		d.offset++
+		f.Skipped++
+	}
+
+	f.Offset = d.offset
+	f.Magic = header.Magic
+	f.Version = header.Version
+	f.Type = header.Type
+	f.Flags = header.Flags
+	f.BodySize = int(header.BodySize)
+
+	d.r.Discard(MsgHeaderSize)
+	body := make([]byte, f.BodySize)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return nil, xerr.Errorf("Truncated frame at offset %d, BodySize=%d", f.Offset, f.BodySize)
+	}
+	d.offset += int64(MsgHeaderSize + f.BodySize)
+
+	if f.Encrypted() {
+		// The following fragments can't be reassembled either
+		d.fragments = nil
+		return f, nil
+	}
+
+	if f.More() || d.fragments != nil {
+		if d.fragments == nil {
+			d.fragHeader = header
+			d.fragments = []byte{}
+		} else if header.Type != d.fragHeader.Type {
+			d.fragments = nil
+			f.Err = xerr.Errorf("Fragments of different messages interleaved")
+			return f, nil
+		}
+		if len(d.fragments) + len(body) > d.MaxSize {
+			d.fragments = nil
+			f.Err = xerr.Errorf("Fragmented message size too large, should less than %d", d.MaxSize)
+			return f, nil
+		}
+		d.fragments = append(d.fragments, body...)
+		if f.More() {
+			return f, nil
+		}
+		header = d.fragHeader
+		header.Flags &^= FLAG_MORE
+		body = d.fragments
+		d.fragments = nil
+	}
+
+	if (header.Flags & FLAG_COMPRESS) != 0 {
+		var err error
+		if body, err = decompressBody(body, d.MaxSize); err != nil {
+			f.Err = err
+			return f, nil
+		}
+	}
+	header.BodySize = int32(len(body))
+	f.Err = f.decode(header, body)
+	return f, nil
+}
+
+func (f *Frame) decode(header _MessageHeader, body []byte) error {
+	msg, err := DecodeMessage(header, body)
+	if err != nil {
+		return err
+	}
+	return f.decodeMsg(msg)
+}
+
+func (f *Frame) decodeMsg(msg _Message) error {
+	var err error
+	var im *_InMsg
+	switch m := msg.(type) {
+	case *_InQuest:
+		f.Txid, f.Service, f.Method, f.Ctx = m.txid, m.service, m.method, m.ctx
+		im = &m._InMsg
+	case *_InAnswer:
+		f.Txid, f.Status = m.txid, m.status
+		im = &m._InMsg
+	case *_InCheck:
+		f.Cmd = m.cmd
+		im = &m._InMsg
+	case *_InBatch:
+		for _, item := range m.items {
+			it := &Frame{Offset:f.Offset, Magic:f.Magic, Version:f.Version, BodySize:len(item)}
+			if m.msgType == BatchQuestMsgType {
+				it.Type = QuestMsgType
+				it.Err = it.decodeMsg(newInQuest(item, false))
+			} else {
+				it.Type = AnswerMsgType
+				it.Err = it.decodeMsg(newInAnswer(item, false))
+			}
+			f.Items = append(f.Items, it)
+		}
+	}
+
+	if im != nil {
+		f.Args = NewArguments()
+		if err = im.DecodeArgs(&f.Args); err != nil {
+			return err
+		}
+	}
+	f.Decoded = true
+	return nil
+}
@@ -0,0 +1,82 @@
+package xic
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDissector(t *testing.T) {
+	var stream bytes.Buffer
+	stream.WriteString("garbage")
+	stream.Write(newOutCheck(ck_AUTHENTICATE, map[string]any{"method":"SRP6a"}).Bytes())
+
+	q := newOutQuest(5, "Demo", "echo", Context{"CALLER":"test"}, map[string]any{"x":1})
+	stream.Write(q.Bytes())
+
+	// compressed and fragmented
+	args := map[string]any{"keys": bytes.Repeat([]byte("key:0123456789,"), 1000)}
+	cbuf := compressMessage(newOutAnswer(answer_NORMAL, 5, args).Bytes())
+	body := cbuf[MsgHeaderSize:]
+	half := len(body) / 2
+	var head [MsgHeaderSize]byte
+	hdr := _MessageHeader{'X', '!', AnswerMsgType, FLAG_COMPRESS | FLAG_MORE, int32(half)}
+	hdr.FillBuffer(head[:])
+	stream.Write(head[:])
+	stream.Write(body[:half])
+	hdr = _MessageHeader{'X', '!', AnswerMsgType, FLAG_COMPRESS, int32(len(body) - half)}
+	hdr.FillBuffer(head[:])
+	stream.Write(head[:])
+	stream.Write(body[half:])
+
+	hdr = _MessageHeader{'X', '!', QuestMsgType, FLAG_CIPHER, 20}
+	hdr.FillBuffer(head[:])
+	stream.Write(head[:])
+	stream.Write(make([]byte, 20))
+	stream.Write(theByeMessage.Bytes())
+
+	d := NewDissector(&stream)
+	var frames []*Frame
+	for {
+		f, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, f)
+	}
+	if len(frames) != 6 {
+		t.Fatalf("Wrong number of frames %d", len(frames))
+	}
+
+	f := frames[0]
+	if f.Skipped != 7 || f.Offset != 7 || f.Type != CheckMsgType || !f.Decoded || f.Cmd != ck_AUTHENTICATE || f.Args.GetString("method") != "SRP6a" {
+		t.Errorf("Wrong check frame %+v", f)
+	}
+	f = frames[1]
+	if !f.Decoded || f.Txid != 5 || f.Service != "Demo" || f.Method != "echo" || f.Ctx.GetString("CALLER", "") != "test" || f.Args.GetInt("x") != 1 {
+		t.Errorf("Wrong quest frame %+v", f)
+	}
+	f = frames[2]
+	if f.Decoded || !f.More() || f.FlagsString() != "COMPRESS|MORE" {
+		t.Errorf("Wrong fragment frame %+v", f)
+	}
+	f = frames[3]
+	if !f.Decoded || f.Err != nil || f.Txid != 5 || f.Status != answer_NORMAL || !bytes.Equal(f.Args.GetBlob("keys"), args["keys"].([]byte)) {
+		t.Errorf("Wrong answer frame %+v", f)
+	}
+	f = frames[4]
+	if f.Decoded || !f.Encrypted() || f.BodySize != 20 {
+		t.Errorf("Wrong encrypted frame %+v", f)
+	}
+	f = frames[5]
+	if !f.Decoded || f.Type != ByeMsgType {
+		t.Errorf("Wrong bye frame %+v", f)
+	}
+
+	d = NewDissector(bytes.NewReader(q.Bytes()[:12]))
+	if _, err := d.Next(); err == nil || err == io.EOF {
+		t.Errorf("Truncated frame should fail")
+	}
+}
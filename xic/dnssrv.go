@@ -0,0 +1,200 @@
+package xic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"halftwo/mangos/dlog"
+	"halftwo/mangos/xerr"
+)
+
+/*
+   The DNS SRV resolver maps service "Demo" to the SRV records of
+   "_Demo._tcp.<domain>". Only the records of the highest priority
+   (the lowest number) are used, the weights of the records are kept
+   in the endpoints as "weight=N".
+
+   The records are resolved again every ttl, and when Refresh() is
+   called, e.g. after failing to connect to an endpoint.
+*/
+type _DnsSrvResolver struct {
+	domain string
+	resolver *net.Resolver
+	ttl time.Duration
+	services map[string]*_SrvService
+	mutex sync.Mutex
+	doneChan chan struct{}
+	once sync.Once
+}
+
+type _SrvService struct {
+	name string
+	endpoints []string
+	expire time.Time
+	watchers []func([]string)
+	refreshChan chan struct{}
+}
+
+var _ Resolver = (*_DnsSrvResolver)(nil)
+
+const DEFAULT_RESOLVER_TTL = time.Second * 60
+const _MIN_RESOLVE_INTERVAL = time.Second
+const _DNS_LOOKUP_TIMEOUT = time.Second * 5
+
+// If resolver is nil, net.DefaultResolver is used.
+func NewDnsSrvResolver(domain string, resolver *net.Resolver, ttl time.Duration) Resolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_RESOLVER_TTL
+	}
+	dr := &_DnsSrvResolver{domain:domain, resolver:resolver, ttl:ttl, doneChan:make(chan struct{})}
+	dr.services = make(map[string]*_SrvService)
+	return dr
+}
+
+func (dr *_DnsSrvResolver) lookup(service string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), _DNS_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	_, srvs, err := dr.resolver.LookupSRV(ctx, service, "tcp", dr.domain)
+	if err != nil {
+		return nil, xerr.Tracef(err, "LookupSRV() failed for service \"%s\"", service)
+	}
+	if len(srvs) == 0 {
+		return nil, newExf(ServiceNotFoundException, "No SRV record for service %#v", service)
+	}
+
+	// The records are sorted by priority
+	var endpoints []string
+	for _, srv := range srvs {
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		endpoint := fmt.Sprintf("@tcp+%s+%d", host, srv.Port)
+		if srv.Weight > 0 {
+			endpoint += fmt.Sprintf(" weight=%d", srv.Weight)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	// LookupSRV() shuffles the records of the same priority by weight,
+	// sort them so the changes can be found by equalStrings()
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+func (dr *_DnsSrvResolver) getService(service string) *_SrvService {
+	s, ok := dr.services[service]
+	if !ok {
+		s = &_SrvService{name:service, refreshChan:make(chan struct{}, 1)}
+		dr.services[service] = s
+	}
+	return s
+}
+
+func (dr *_DnsSrvResolver) Resolve(service string) ([]string, error) {
+	dr.mutex.Lock()
+	s := dr.getService(service)
+	if s.endpoints != nil && time.Now().Before(s.expire) {
+		endpoints := s.endpoints
+		dr.mutex.Unlock()
+		return endpoints, nil
+	}
+	dr.mutex.Unlock()
+
+	endpoints, err := dr.lookup(service)
+	if err != nil {
+		return nil, err
+	}
+
+	dr.mutex.Lock()
+	s.endpoints = endpoints
+	s.expire = time.Now().Add(dr.ttl)
+	dr.mutex.Unlock()
+	return endpoints, nil
+}
+
+func (dr *_DnsSrvResolver) Watch(service string, fn func(endpoints []string)) {
+	dr.mutex.Lock()
+	s := dr.getService(service)
+	s.watchers = append(s.watchers, fn)
+	first := len(s.watchers) == 1
+	dr.mutex.Unlock()
+
+	if first {
+		go dr.refresh_routine(s)
+	}
+}
+
+func (dr *_DnsSrvResolver) Refresh(service string) {
+	dr.mutex.Lock()
+	s, ok := dr.services[service]
+	dr.mutex.Unlock()
+
+	if ok {
+		select {
+		case s.refreshChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (dr *_DnsSrvResolver) refresh_routine(s *_SrvService) {
+	timer := time.NewTimer(dr.ttl)
+	defer timer.Stop()
+	for {
+		select {
+		case <-dr.doneChan:
+			return
+		case <-timer.C:
+		case <-s.refreshChan:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		endpoints, err := dr.lookup(s.name)
+		if err != nil {
+			dlog.Log("XIC.WARN", "Failed to resolve service %#v: %s", s.name, err.Error())
+		} else {
+			dr.mutex.Lock()
+			changed := !equalStrings(s.endpoints, endpoints)
+			s.endpoints = endpoints
+			s.expire = time.Now().Add(dr.ttl)
+			watchers := s.watchers
+			dr.mutex.Unlock()
+
+			if changed {
+				dlog.Log("XIC.INFO", "Endpoints of service %#v resolved to %v", s.name, endpoints)
+				for _, fn := range watchers {
+					fn(endpoints)
+				}
+			}
+		}
+
+		// Don't resolve too often when the connections keep failing
+		select {
+		case <-dr.doneChan:
+			return
+		case <-time.After(_MIN_RESOLVE_INTERVAL):
+		}
+		timer.Reset(dr.ttl - _MIN_RESOLVE_INTERVAL)
+	}
+}
+
+func (dr *_DnsSrvResolver) Close() {
+	dr.once.Do(func() {
+		close(dr.doneChan)
+	})
+}
+
@@ -0,0 +1,151 @@
+package xic
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type _StubSrv struct {
+	target string
+	port uint16
+	priority uint16
+	weight uint16
+}
+
+// A minimal DNS server answering any question with the SRV records
+type _StubDns struct {
+	pc net.PacketConn
+	mutex sync.Mutex
+	records []_StubSrv
+}
+
+func newStubDns(t *testing.T) *_StubDns {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := &_StubDns{pc:pc}
+	go sd.serve()
+	return sd
+}
+
+func (sd *_StubDns) setRecords(records []_StubSrv) {
+	sd.mutex.Lock()
+	sd.records = records
+	sd.mutex.Unlock()
+}
+
+func appendDnsName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+func (sd *_StubDns) serve() {
+	var query [512]byte
+	for {
+		n, addr, err := sd.pc.ReadFrom(query[:])
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+
+		// the question ends after the name, type and class
+		end := 12
+		for end < n && query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+
+		sd.mutex.Lock()
+		records := sd.records
+		sd.mutex.Unlock()
+
+		resp := make([]byte, 12, 512)
+		copy(resp, query[:2])
+		binary.BigEndian.PutUint16(resp[2:], 0x8180)
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+		resp = append(resp, query[12:end]...)
+		for _, r := range records {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[0:], r.priority)
+			binary.BigEndian.PutUint16(rdata[2:], r.weight)
+			binary.BigEndian.PutUint16(rdata[4:], r.port)
+			rdata = appendDnsName(rdata, r.target)
+
+			resp = append(resp, 0xC0, 12)		// pointer to the question name
+			resp = append(resp, 0, 33, 0, 1)	// SRV, IN
+			resp = append(resp, 0, 0, 0, 60)	// ttl
+			resp = append(resp, byte(len(rdata) >> 8), byte(len(rdata)))
+			resp = append(resp, rdata...)
+		}
+		sd.pc.WriteTo(resp, addr)
+	}
+}
+
+func (sd *_StubDns) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", sd.pc.LocalAddr().String())
+		},
+	}
+}
+
+func TestDnsSrvResolver(t *testing.T) {
+	sd := newStubDns(t)
+	defer sd.pc.Close()
+	sd.setRecords([]_StubSrv{
+		{"a.example.com.", 5555, 10, 60},
+		{"b.example.com.", 5555, 10, 40},
+		{"backup.example.com.", 5555, 20, 0},
+	})
+
+	dr := NewDnsSrvResolver("example.com", sd.resolver(), time.Hour)
+	defer dr.Close()
+
+	eps, err := dr.Resolve("Demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != 2 || !strings.Contains(strings.Join(eps, " "), "@tcp+a.example.com+5555 weight=60") {
+		t.Fatalf("Resolve() got %v", eps)
+	}
+
+	// The order of the records of the same priority is random
+	for i := 0; i < 20; i++ {
+		if eps2, _ := dr.(*_DnsSrvResolver).lookup("Demo"); !equalStrings(eps, eps2) {
+			t.Fatalf("lookup() got %v, then %v", eps, eps2)
+		}
+	}
+
+	ch := make(chan []string, 1)
+	dr.Watch("Demo", func(endpoints []string) {
+		ch <- endpoints
+	})
+
+	sd.setRecords([]_StubSrv{{"c.example.com.", 6666, 10, 0}})
+	dr.Refresh("Demo")
+	select {
+	case eps = <-ch:
+		if len(eps) != 1 || eps[0] != "@tcp+c.example.com+6666" {
+			t.Errorf("Watch() got %v", eps)
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("Watch() not called after Refresh()")
+	}
+}
@@ -18,6 +18,7 @@ type EndpointInfo struct {
 	timeout uint32
 	closeTimeout uint32
 	connectTimeout uint32
+	weight uint32
 }
 
 func str2timeout(s string) uint32 {
@@ -70,12 +71,22 @@ func parseEndpoint(endpoint string) (*EndpointInfo, error) {
 			ei.timeout = str2timeout(sp.Next())
 			ei.closeTimeout = str2timeout(sp.Next())
 			ei.connectTimeout = str2timeout(sp.Next())
+		} else if key == "weight" {
+			ei.weight = str2timeout(value)
 		}
 	}
 	// TODO
 	return ei, nil
 }
 
+// Default weight is 1
+func (ei *EndpointInfo) Weight() uint32 {
+	if ei.weight == 0 {
+		return 1
+	}
+	return ei.weight
+}
+
 func (ei *EndpointInfo) Proto() string {
 	return ei.proto
 }
@@ -99,6 +110,9 @@ func (ei *EndpointInfo) String() string {
 			fmt.Fprintf(b, ",%d,%d", ei.closeTimeout, ei.connectTimeout)
 		}
 	}
+	if ei.weight > 0 {
+		fmt.Fprintf(b, " weight=%d", ei.weight)
+	}
 	return b.String()
 }
 
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"sync"
 	"sync/atomic"
+	"net/http"
 
 	"halftwo/mangos/dlog"
 	"halftwo/mangos/xerr"
@@ -32,17 +33,40 @@ type _Engine struct {
 	numQ atomic.Int32
 
 	cipher _CipherSuite
-	shadowBox *ShadowBox
-	secretBox *SecretBox
-
+	authMethod string
+	rekeyMessages int64
+	rekeyInterval time.Duration
+	shadowBox atomic.Pointer[ShadowBox]
+	secretBox atomic.Pointer[SecretBox]
+
+	resolver Resolver
+	health *_HealthPolicy
+	breaker *_BreakerPolicy
+	compressThreshold int
+	maxMessageSize int
+	maxFragmentedSize int
+	queueMessages int
+	queueBytes int
+	queueBlock bool
+	traceSample float64
+	tracer atomic.Pointer[_Tracer]
+	metrics *_Metrics
+	recorder *_Recorder
+	faultEnable atomic.Bool
+	priorityMethods map[string]bool
+	reqCache *_ReqCache
+	metricsServer *http.Server
 	keeper *ServantInfo
 	slackAdapter *_Adapter
 	adapterMap map[string]*_Adapter
 	proxyMap map[string]*_Proxy
+	proxyCreating map[string]chan struct{}	// closed after the proxy created, see StringToProxy()
 	outConMap map[string]*_Connection
+	outConRefs map[string]int	// the number of proxies using the endpoints, see refEndpoints()
 	inConList []*_Connection
 
 	sigChan chan os.Signal
+	hupChan chan os.Signal
 
 	startTS string
 	doneChan chan struct{}
@@ -63,10 +87,12 @@ func newEngineSetting(setting Setting) *_Engine {
 		id: GenerateRandomBase57Id(23),
 		maxQ: DEFAULT_ENGINE_MAXQ,
 		sigChan: make(chan os.Signal, 1),
+		hupChan: make(chan os.Signal, 1),
 		doneChan: make(chan struct{}),
 		startTS: dlog.TimeString(time.Now()),
 	}
 	engine.cond.L = &engine.mutex
+	engine.metrics = newMetrics(engine)
 
 	var err error
 	keeper, err := getServantInfo("\x00", &_KeeperServant{engine:engine})
@@ -76,13 +102,17 @@ func newEngineSetting(setting Setting) *_Engine {
 	engine.keeper = keeper
 	engine.adapterMap = make(map[string]*_Adapter)
 	engine.proxyMap = make(map[string]*_Proxy)
+	engine.proxyCreating = make(map[string]chan struct{})
 	engine.outConMap = make(map[string]*_Connection)
+	engine.outConRefs = make(map[string]int)
 
 	shadow := setting.Pathname("xic.passport.shadow")
 	if shadow != "" {
-		engine.shadowBox, err = NewShadowBoxFromFile(shadow)
+		shadowBox, err := NewShadowBoxFromFile(shadow)
 		if err != nil {
 			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to open shadow file %#v", shadow)
+		} else {
+			engine.shadowBox.Store(shadowBox)
 		}
 	}
 
@@ -91,15 +121,74 @@ func newEngineSetting(setting Setting) *_Engine {
 		engine.cipher = AES128_EAX
 	}
 
+	engine.health = newHealthPolicy(setting)
+	engine.breaker = newBreakerPolicy(setting)
+	engine.compressThreshold = int(setting.IntDefault("xic.compress.threshold", 0))
+	engine.maxMessageSize = int(setting.IntDefault("xic.MaxMessageSize", int64(MaxMessageSize)))
+	engine.maxFragmentedSize = int(setting.IntDefault("xic.MaxFragmentedSize", 0))
+	engine.queueMessages = int(setting.IntDefault("xic.queue.messages", 0))
+	engine.queueBytes = int(setting.IntDefault("xic.queue.bytes", 0))
+	engine.queueBlock = setting.BoolDefault("xic.queue.block", false)
+	engine.traceSample = setting.FloatDefault("xic.trace.sample", 1.0)
+	switch exporter := setting.Get("xic.trace.exporter"); exporter {
+	case "":
+	case "dlog":
+		engine.SetSpanExporter(NewDlogSpanExporter())
+	default:
+		dlog.Allog(dlog.Id(), "XIC.WARN", "", "Unknown xic.trace.exporter %#v", exporter)
+	}
+	engine.faultEnable.Store(setting.BoolDefault("xic.fault.enable", false))
+	engine.priorityMethods = parsePriorityMethods(setting.Get("xic.priority.methods"))
+	engine.reqCache = newReqCache(setting)
+	engine.rekeyMessages = setting.IntDefault("xic.rekey.messages", 0)
+	engine.rekeyInterval = time.Minute * time.Duration(setting.IntDefault("xic.rekey.minutes", 0))
+
 	secret := setting.Pathname("xic.passport.secret")
 	if secret != "" {
-		engine.secretBox, err = NewSecretBoxFromFile(secret)
+		secretBox, err := NewSecretBoxFromFile(secret)
 		if err != nil {
 			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to open secret file %#v", secret)
+		} else {
+			engine.secretBox.Store(secretBox)
+		}
+	}
+
+	registry := setting.Pathname("xic.registry.file")
+	if registry != "" {
+		interval := time.Second * time.Duration(setting.IntDefault("xic.registry.interval", 0))
+		engine.resolver, err = NewFileResolver(registry, interval)
+		if err != nil {
+			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to open registry file %#v", registry)
+		}
+	} else if domain := setting.Get("xic.resolver.domain"); domain != "" {
+		ttl := time.Second * time.Duration(setting.IntDefault("xic.resolver.ttl", 0))
+		engine.resolver = NewDnsSrvResolver(domain, nil, ttl)
+	}
+
+	engine.authMethod = setting.GetDefault("xic.passport.auth", auth_SRP6a)
+	switch engine.authMethod {
+	case auth_SRP6a:
+	case auth_PSK:
+		if engine.secretBox.Load() == nil {
+			dlog.Allog(dlog.Id(), "XIC.WARN", "", "xic.passport.auth is %#v but no secret file given, incoming connections will be refused", auth_PSK)
+		}
+	default:
+		dlog.Allog(dlog.Id(), "XIC.WARN", "", "Unknown xic.passport.auth %#v, %#v is used", engine.authMethod, auth_SRP6a)
+		engine.authMethod = auth_SRP6a
+	}
+
+	engine.metricsServer = engine.startMetricsServer()
+
+	record := setting.Pathname("xic.record.file")
+	if record != "" {
+		engine.recorder, err = newRecorder(record, setting.FloatDefault("xic.record.sample", 1.0))
+		if err != nil {
+			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to open record file %#v", record)
 		}
 	}
 
 	go engine.wait_for_shutting_routine()
+	go engine.reload_routine()
 	return engine
 }
 
@@ -135,11 +224,44 @@ func (engine *_Engine) SetMaxQ(max int32) {
 }
 
 func (engine *_Engine) SetSecretBox(sb *SecretBox) {
-	engine.secretBox = sb
+	engine.secretBox.Store(sb)
 }
 
 func (engine *_Engine) SetShadowBox(sb *ShadowBox) {
-	engine.shadowBox = sb
+	engine.shadowBox.Store(sb)
+}
+
+func (engine *_Engine) Resolver() Resolver {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	return engine.resolver
+}
+
+func (engine *_Engine) SetResolver(r Resolver) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.resolver = r
+}
+
+func (engine *_Engine) SpanExporter() SpanExporter {
+	if tracer := engine.tracer.Load(); tracer != nil {
+		return tracer.exporter
+	}
+	return nil
+}
+
+func (engine *_Engine) SetSpanExporter(exp SpanExporter) {
+	if exp == nil {
+		engine.tracer.Store(nil)
+	} else {
+		engine.tracer.Store(&_Tracer{exporter:exp, sample:engine.traceSample})
+	}
+}
+
+func (engine *_Engine) refreshResolver(service string) {
+	if r := engine.Resolver(); r != nil {
+		go r.Refresh(service)
+	}
 }
 
 func (engine *_Engine) Throb(fn func()string) {
@@ -184,6 +306,80 @@ func (engine *_Engine) throb_routine() {
 done:
 }
 
+// Reload the setting file and the shadow and secret files on SIGHUP,
+// or every xic.reload.interval seconds if it's greater than 0.
+func (engine *_Engine) reload_routine() {
+	var tickChan <-chan time.Time
+	interval := engine.setting.IntDefault("xic.reload.interval", 0)
+	if interval > 0 {
+		ticker := time.NewTicker(time.Second * time.Duration(interval))
+		defer ticker.Stop()
+		tickChan = ticker.C
+	}
+
+	for {
+		select {
+		case <-engine.doneChan:
+			return
+		case sig := <-engine.hupChan:
+			dlog.Allog(dlog.Id(), "XIC.INFO", "", "Signal (%s) received, reloading.", sig.String())
+			engine.reload()
+		case <-tickChan:
+			engine.reload()
+		}
+	}
+}
+
+func (engine *_Engine) reload() {
+	var err error
+	if rs, ok := engine.setting.(ReloadableSetting); ok {
+		var changed []string
+		changed, err = rs.Reload()
+		if err != nil {
+			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to reload setting: %s", err.Error())
+		} else if len(changed) > 0 {
+			dlog.Allog(dlog.Id(), "XIC.INFO", "", "Setting reloaded, changed=%v", changed)
+		}
+	}
+	engine.faultEnable.Store(engine.setting.BoolDefault("xic.fault.enable", false))
+
+	shadow := engine.setting.Pathname("xic.passport.shadow")
+	old := engine.shadowBox.Load()
+	// The ShadowBox set by SetShadowBox() (without file) is kept
+	if shadow != "" && (old == nil || old.filename != "") {
+		var sb *ShadowBox
+		if old != nil && old.filename == shadow {
+			sb, err = old.Reload()
+		} else {
+			sb, err = NewShadowBoxFromFile(shadow)
+		}
+		if err != nil {
+			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to reload shadow file %#v: %s", shadow, err.Error())
+		} else if sb != nil {
+			engine.shadowBox.Store(sb)
+			dlog.Allog(dlog.Id(), "XIC.INFO", "", "Shadow file %#v reloaded", shadow)
+		}
+	}
+
+	secret := engine.setting.Pathname("xic.passport.secret")
+	oldsb := engine.secretBox.Load()
+	// The SecretBox set by SetSecretBox() (without file) is kept
+	if secret != "" && (oldsb == nil || oldsb.filename != "") {
+		var sb *SecretBox
+		if oldsb != nil && oldsb.filename == secret {
+			sb, err = oldsb.Reload()
+		} else {
+			sb, err = NewSecretBoxFromFile(secret)
+		}
+		if err != nil {
+			dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to reload secret file %#v: %s", secret, err.Error())
+		} else if sb != nil {
+			engine.secretBox.Store(sb)
+			dlog.Allog(dlog.Id(), "XIC.INFO", "", "Secret file %#v reloaded", secret)
+		}
+	}
+}
+
 func (engine *_Engine) CreateAdapter(name string) (Adapter, error) {
 	return engine.CreateAdapterEndpoints(name, "")
 }
@@ -228,6 +424,12 @@ func (engine *_Engine) CreateSlackAdapter() (Adapter, error) {
 	return adapter, nil
 }
 
+func (engine *_Engine) getSlackAdapter() *_Adapter {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	return engine.slackAdapter
+}
+
 func addAdapter(engine *_Engine, adapter *_Adapter) error {
 	engine.mutex.Lock()
 	defer engine.mutex.Unlock()
@@ -258,20 +460,78 @@ func (engine *_Engine) getAllAdapters(aps map[string]string) {
 	}
 }
 
-func (engine *_Engine) StringToProxy(proxy string) (Proxy, error) {
+func (engine *_Engine) getAllProxies() []*_Proxy {
 	engine.mutex.Lock()
 	defer engine.mutex.Unlock()
-	if engine.state != eng_ACTIVE {
-		return nil, ErrEngineShutted
+
+	prxs := make([]*_Proxy, 0, len(engine.proxyMap))
+	for _, prx := range engine.proxyMap {
+		prxs = append(prxs, prx)
 	}
+	return prxs
+}
 
-	prx, ok := engine.proxyMap[proxy]
-	if ok {
-		return prx, nil
+// The live incoming and outgoing connections
+func (engine *_Engine) getAllConnections() []*_Connection {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	cons := make([]*_Connection, 0, len(engine.inConList) + len(engine.outConMap))
+	for _, con := range engine.inConList {
+		if con.IsLive() {
+			cons = append(cons, con)
+		}
 	}
+	for _, con := range engine.outConMap {
+		if con.IsLive() {
+			cons = append(cons, con)
+		}
+	}
+	return cons
+}
+
+// Only one proxy is created for the same string, the others wait for it,
+// since the proxy references the endpoints and watches the resolver.
+func (engine *_Engine) StringToProxy(proxy string) (Proxy, error) {
+	engine.mutex.Lock()
+	for {
+		if engine.state != eng_ACTIVE {
+			engine.mutex.Unlock()
+			return nil, ErrEngineShutted
+		}
+		if prx, ok := engine.proxyMap[proxy]; ok {
+			engine.mutex.Unlock()
+			return prx, nil
+		}
+		creating, ok := engine.proxyCreating[proxy]
+		if !ok {
+			break
+		}
+		engine.mutex.Unlock()
+		<-creating
+		engine.mutex.Lock()
+	}
+	creating := make(chan struct{})
+	engine.proxyCreating[proxy] = creating
+	resolver := engine.resolver
+	engine.mutex.Unlock()
+
+	// newProxy() may call the resolver, don't hold the lock
+	prx := newProxy(engine, proxy, resolver)
 
-	prx = newProxy(engine, proxy)
-	engine.proxyMap[proxy] = prx
+	engine.mutex.Lock()
+	delete(engine.proxyCreating, proxy)
+	close(creating)
+	active := engine.state == eng_ACTIVE
+	if active {
+		engine.proxyMap[proxy] = prx
+	}
+	engine.mutex.Unlock()
+
+	if !active {
+		prx.release()
+		return nil, ErrEngineShutted
+	}
 	return prx, nil
 }
 
@@ -319,8 +579,19 @@ func (engine *_Engine) wait_for_shutting_routine() {
 	engine.outConMap = nil
 
 	engine.proxyMap = nil
+	resolver := engine.resolver
 	engine.mutex.Unlock()
 
+	if resolver != nil {
+		resolver.Close()
+	}
+	if engine.metricsServer != nil {
+		engine.metricsServer.Close()
+	}
+	if engine.recorder != nil {
+		engine.recorder.Close()
+	}
+
 	for _, a := range adapterMap {
 		a.Deactivate()
 	}
@@ -366,6 +637,43 @@ func (engine *_Engine) makeConnection(serviceHint string, endpoint string) (*_Co
 	return con, nil
 }
 
+// The outgoing connection to an endpoint is shared by all the proxies with
+// the endpoint. Each proxy references the endpoints it has, and releases
+// them by dropConnection() when they are removed from the proxy.
+func (engine *_Engine) refEndpoints(endpoints []string) {
+	if len(endpoints) == 0 {
+		return
+	}
+	engine.mutex.Lock()
+	for _, ep := range endpoints {
+		engine.outConRefs[ep]++
+	}
+	engine.mutex.Unlock()
+}
+
+// Release the reference to the endpoint by a proxy, and close the outgoing
+// connection to the endpoint if no proxy uses it any more. The connection
+// used by a fixed proxy (see CreateFixedProxy()) is not closed.
+func (engine *_Engine) dropConnection(endpoint string) {
+	engine.mutex.Lock()
+	n := engine.outConRefs[endpoint] - 1
+	if n > 0 {
+		engine.outConRefs[endpoint] = n
+	} else {
+		delete(engine.outConRefs, endpoint)
+	}
+	con, ok := engine.outConMap[endpoint]
+	ok = ok && n <= 0 && !con.fixed.Load()
+	if ok {
+		delete(engine.outConMap, endpoint)
+	}
+	engine.mutex.Unlock()
+
+	if ok {
+		con.closeGracefully()
+	}
+}
+
 func (engine *_Engine) incomingConnection(con *_Connection) {
 	engine.mutex.Lock()
 	defer engine.mutex.Unlock()
@@ -11,6 +11,7 @@ const (
 	ProtocolException ExNameType	= "ProtocolException"
 	ConnectionClosedException	= "ConnectionClosedException"
 	QuestNotServedException         = "QuestNotServedException"
+	QuestCanceledException		= "QuestCanceledException"
 )
 
 const (
@@ -22,6 +23,10 @@ const (
 	EngineOverloadException		= "EngineOverloadException"
 	AuthFailedException		= "AuthFailedException"
 	InvalidParameterException	= "InvalidParameterException"
+	NoEndpointException		= "NoEndpointException"
+	CircuitOpenException		= "CircuitOpenException"
+	InjectedFaultException		= "InjectedFaultException"
+	MessageSizeException		= "MessageSizeException"
 )
 
 type _Exception struct {
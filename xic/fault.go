@@ -0,0 +1,75 @@
+package xic
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+/*
+   If xic.fault.enable is true, faults are injected into the quests served
+   for resilience tests. The faults of a quest are given by the settings
+   xic.fault.<target>.<fault>, and the target is looked up in the order of
+   "<service>::<method>", "<service>" and "*", e.g.
+	xic.fault.Demo::echo.delay = 200
+	xic.fault.Demo.drop = 0.1
+   The faults are:
+	delay		milliseconds to delay the quest before it is served
+	exception	probability to answer an exception without serving the quest
+	exname		name of the injected exception, InjectedFaultException by default
+	drop		probability to drop the answer, as if it were lost
+	close		probability to close the connection instead of answering
+
+   The quests of the keeper service are not affected. The fault settings
+   are read for each quest, so the faults can be changed by reloading the
+   setting file.
+*/
+type _Fault struct {
+	delay time.Duration
+	exception error		// nil if not injected
+	drop bool
+	close bool
+}
+
+func (engine *_Engine) faultSetting(service, method, fault string) string {
+	for _, target := range [3]string{service + "::" + method, service, "*"} {
+		if v := engine.setting.Get("xic.fault." + target + "." + fault); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (engine *_Engine) faultHappened(service, method, fault string) bool {
+	p, _ := strconv.ParseFloat(engine.faultSetting(service, method, fault), 64)
+	return p > 0 && (p >= 1.0 || rand.Float64() < p)
+}
+
+// Return nil if no fault injected into the quest
+func (engine *_Engine) injectFault(quest *_InQuest) *_Fault {
+	if !engine.faultEnable.Load() || quest.service == "\x00" {
+		return nil
+	}
+
+	f := &_Fault{}
+	service, method := quest.service, quest.method
+	if ms, _ := strconv.Atoi(engine.faultSetting(service, method, "delay")); ms > 0 {
+		f.delay = time.Millisecond * time.Duration(ms)
+	}
+	if engine.faultHappened(service, method, "exception") {
+		exname := engine.faultSetting(service, method, "exname")
+		if exname == "" {
+			exname = string(InjectedFaultException)
+		}
+		f.exception = newExf(ExNameType(exname), "Fault injected into %s::%s", service, method)
+	}
+	if quest.txid != 0 {
+		f.drop = engine.faultHappened(service, method, "drop")
+	}
+	f.close = engine.faultHappened(service, method, "close")
+
+	if f.delay == 0 && f.exception == nil && !f.drop && !f.close {
+		return nil
+	}
+	return f
+}
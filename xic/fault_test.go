@@ -0,0 +1,44 @@
+package xic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInjectFault(t *testing.T) {
+	setting := NewSetting()
+	setting.Set("xic.fault.Demo::echo.delay", "200")
+	setting.Set("xic.fault.Demo.exception", "1")
+	setting.Set("xic.fault.Demo.exname", "EngineOverloadException")
+	setting.Set("xic.fault.*.drop", "1")
+	engine := newEngineSetting(setting)
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+
+	quest := &_InQuest{txid:1, service:"Demo", method:"echo"}
+	if engine.injectFault(quest) != nil {
+		t.Fatalf("Fault injected while xic.fault.enable is false")
+	}
+
+	engine.faultEnable.Store(true)
+	f := engine.injectFault(quest)
+	if f == nil || f.delay != time.Millisecond * 200 || !f.drop || f.close {
+		t.Fatalf("Wrong fault %+v", f)
+	}
+	if ex, ok := f.exception.(Exception); !ok || ex.Name() != EngineOverloadException {
+		t.Errorf("Wrong injected exception %v", f.exception)
+	}
+
+	f = engine.injectFault(&_InQuest{txid:1, service:"Demo", method:"time"})
+	if f == nil || f.delay != 0 || f.exception == nil || !f.drop {
+		t.Errorf("Wrong fault %+v", f)
+	}
+
+	// The answer of oneway quest can't be dropped
+	if f = engine.injectFault(&_InQuest{service:"Other", method:"echo"}); f != nil {
+		t.Errorf("Wrong fault %+v", f)
+	}
+	if f = engine.injectFault(&_InQuest{txid:1, service:"\x00", method:"echo"}); f != nil {
+		t.Errorf("Fault injected into the keeper service")
+	}
+}
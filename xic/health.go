@@ -0,0 +1,230 @@
+package xic
+
+import (
+	"sync"
+	"time"
+
+	"halftwo/mangos/dlog"
+)
+
+/*
+   An endpoint of a proxy is ejected for a backoff period after
+   xic.health.failures consecutive failures, or when its average latency
+   is greater than xic.health.latency milliseconds. The backoff period
+   begins with xic.health.eject milliseconds, and is doubled on each
+   consecutive ejection up to xic.health.eject.max milliseconds.
+
+   If xic.health.probe is true, an ejected endpoint is probed through the
+   keeper service after the backoff period, and is used again only after
+   the probe succeeds.
+*/
+type _HealthPolicy struct {
+	failures int
+	latency time.Duration
+	eject time.Duration
+	ejectMax time.Duration
+	probe bool
+}
+
+const (
+	_DEFAULT_HEALTH_FAILURES = 5
+	_DEFAULT_HEALTH_EJECT = time.Second * 10
+	_DEFAULT_HEALTH_EJECT_MAX = time.Second * 300
+	_HEALTH_LATENCY_SAMPLES = 10
+	_HEALTH_PROBE_INTERVAL = time.Second
+	_HEALTH_PROBE_TIMEOUT = time.Second * 5
+)
+
+func newHealthPolicy(setting Setting) *_HealthPolicy {
+	hp := &_HealthPolicy{}
+	hp.failures = int(setting.IntDefault("xic.health.failures", _DEFAULT_HEALTH_FAILURES))
+	hp.latency = time.Millisecond * time.Duration(setting.IntDefault("xic.health.latency", 0))
+	hp.eject = time.Millisecond * time.Duration(setting.IntDefault("xic.health.eject", int64(_DEFAULT_HEALTH_EJECT / time.Millisecond)))
+	hp.ejectMax = time.Millisecond * time.Duration(setting.IntDefault("xic.health.eject.max", int64(_DEFAULT_HEALTH_EJECT_MAX / time.Millisecond)))
+	hp.probe = setting.BoolDefault("xic.health.probe", false)
+	if hp.ejectMax < hp.eject {
+		hp.ejectMax = hp.eject
+	}
+	return hp
+}
+
+type _Health struct {
+	policy *_HealthPolicy
+	service string
+	endpoint string
+
+	mutex sync.Mutex
+	failures int		// consecutive failures
+	samples int
+	latency time.Duration	// exponentially weighted moving average
+	ejections int		// consecutive ejections
+	ejectedUntil time.Time
+	needProbe bool
+}
+
+func newHealth(policy *_HealthPolicy, service, endpoint string) *_Health {
+	return &_Health{policy:policy, service:service, endpoint:endpoint}
+}
+
+// The errors of the connection, and the overload exceptions from the peer
+// are failures of the endpoint. Other remote exceptions are not.
+func isEndpointFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	ex, ok := err.(Exception)
+	if !ok {
+		return true
+	}
+	switch ex.Name() {
+	case ConnectionOverloadException, EngineOverloadException:
+		return true
+	}
+	return !ex.IsRemote()
+}
+
+// Return true if the endpoint is ejected by this record
+func (h *_Health) record(err error, latency time.Duration) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(h.ejectedUntil) {
+		return false
+	}
+
+	if isEndpointFailure(err) {
+		h.failures++
+		if h.policy.failures > 0 && h.failures >= h.policy.failures {
+			h._eject(now, "consecutive failures")
+			return true
+		}
+		return false
+	}
+
+	h.failures = 0
+	h.ejections = 0
+	if h.samples == 0 {
+		h.latency = latency
+	} else {
+		h.latency += (latency - h.latency) / 8
+	}
+	h.samples++
+	if h.policy.latency > 0 && h.samples >= _HEALTH_LATENCY_SAMPLES && h.latency > h.policy.latency {
+		h._eject(now, "high latency")
+		return true
+	}
+	return false
+}
+
+func (h *_Health) _eject(now time.Time, reason string) {
+	d := h.policy.eject
+	for i := 0; i < h.ejections && d < h.policy.ejectMax; i++ {
+		d *= 2
+	}
+	if d > h.policy.ejectMax {
+		d = h.policy.ejectMax
+	}
+	h.ejections++
+	h.ejectedUntil = now.Add(d)
+	h.needProbe = h.policy.probe
+	h.failures = 0
+	h.samples = 0
+	dlog.Log("XIC.WARN", "Endpoint %s of service %s ejected for %v, reason=%s", h.endpoint, h.service, d, reason)
+}
+
+func (h *_Health) ejected(now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.needProbe || now.Before(h.ejectedUntil)
+}
+
+func (h *_Health) Latency() time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.latency
+}
+
+func (h *_Health) probeDue(now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.needProbe && !now.Before(h.ejectedUntil)
+}
+
+func (h *_Health) probed(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err == nil {
+		h.needProbe = false
+		dlog.Log("XIC.INFO", "Endpoint %s of service %s probed ok", h.endpoint, h.service)
+	} else {
+		h._eject(time.Now(), "probe failed")
+	}
+}
+
+// Invoke the keeper service of the endpoint
+func (prx *_Proxy) probe(h *_Health) error {
+	con, err := prx.engine.makeConnection(prx.service, h.endpoint)
+	if err != nil {
+		return err
+	}
+	kp := newProxyWithConnection(prx.engine, "\x00", con)
+	res := kp.InvokeAsync("adapters", nil, nil)
+
+	done := make(chan struct{})
+	go func() {
+		res.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return res.Err()
+	case <-time.After(_HEALTH_PROBE_TIMEOUT):
+		return newEx(ConnectionClosedException, "probe timeout")
+	}
+}
+
+func (prx *_Proxy) probe_routine() {
+	for {
+		time.Sleep(_HEALTH_PROBE_INTERVAL)
+		if prx.engine.Shutted() {
+			break
+		}
+
+		now := time.Now()
+		pending := false
+		var due []*_Health
+		prx.mutex.Lock()
+		for _, h := range prx.healths {
+			if h.probeDue(now) {
+				due = append(due, h)
+			}
+			if h.ejected(now) {
+				pending = true
+			}
+		}
+		if !pending {
+			prx.probing = false
+			prx.mutex.Unlock()
+			break
+		}
+		prx.mutex.Unlock()
+
+		for _, h := range due {
+			h.probed(prx.probe(h))
+		}
+	}
+}
+
+func (prx *_Proxy) startProbing() {
+	prx.mutex.Lock()
+	start := !prx.probing
+	prx.probing = true
+	prx.mutex.Unlock()
+
+	if start {
+		go prx.probe_routine()
+	}
+}
+
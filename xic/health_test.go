@@ -0,0 +1,66 @@
+package xic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthEject(t *testing.T) {
+	hp := &_HealthPolicy{failures:3, latency:time.Millisecond * 100, eject:time.Second, ejectMax:time.Second * 3}
+	h := newHealth(hp, "Demo", "@tcp+localhost+3030")
+	fail := errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		if h.record(fail, 0) {
+			t.Fatalf("ejected after %d failures", i + 1)
+		}
+	}
+	h.record(nil, time.Millisecond)
+	h.record(fail, 0)
+	h.record(fail, 0)
+	if !h.record(fail, 0) {
+		t.Fatalf("not ejected after 3 consecutive failures")
+	}
+
+	now := time.Now()
+	if !h.ejected(now) || h.ejected(now.Add(time.Second * 2)) {
+		t.Errorf("wrong ejection period")
+	}
+
+	// Backoff doubled, limited by ejectMax
+	h.ejectedUntil = time.Time{}
+	for i := 0; i < 3; i++ {
+		h.record(fail, 0)
+	}
+	if !h.ejected(now.Add(time.Millisecond * 1500)) {
+		t.Errorf("backoff not doubled")
+	}
+	h.ejectedUntil = time.Time{}
+	h.ejections = 10
+	for i := 0; i < 3; i++ {
+		h.record(fail, 0)
+	}
+	if h.ejected(now.Add(time.Millisecond * 3500)) {
+		t.Errorf("backoff not limited")
+	}
+
+	// Remote exceptions are not failures of the endpoint
+	h.ejectedUntil = time.Time{}
+	ex := newEx(MethodNotFoundException, "")
+	ex.remote = true
+	for i := 0; i < 5; i++ {
+		if h.record(ex, 0) {
+			t.Errorf("ejected by remote exception")
+		}
+	}
+
+	// High latency
+	h = newHealth(hp, "Demo", "@tcp+localhost+3030")
+	for i := 0; i < _HEALTH_LATENCY_SAMPLES - 1; i++ {
+		h.record(nil, time.Millisecond * 200)
+	}
+	if !h.record(nil, time.Millisecond * 200) {
+		t.Errorf("not ejected by high latency")
+	}
+}
@@ -1,8 +1,11 @@
 package xic
 
 import (
+	"context"
 	"os"
 	"reflect"
+
+	"halftwo/mangos/metrics"
 )
 
 /*
@@ -86,6 +89,20 @@ type Setting interface {
 	LoadFile(filename string) error
 }
 
+// The Setting returned by NewSetting() and NewSettingFile() is reloadable.
+// The engine reloads its Setting only if it implements ReloadableSetting.
+type ReloadableSetting interface {
+	Setting
+
+	// Reload the loaded file, return the names of changed items.
+	// The items set by Set(), Remove() or Insert() win over the file.
+	Reload() ([]string, error)
+	Watch(fn SettingWatcher)
+}
+
+// Called by ReloadableSetting.Reload() with the names of changed items
+type SettingWatcher func(st Setting, changed []string)
+
 
 type Engine interface {
 	Id() string		// universal unique
@@ -97,7 +114,9 @@ type Engine interface {
 	CreateAdapter(name string) (Adapter, error)
 	CreateAdapterEndpoints(name string, endpoints string) (Adapter, error)
 
-	// slack adapter has no endpoints
+	// slack adapter has no endpoints.
+	// The quests from the peers of outgoing connections, e.g. the
+	// callbacks from the servers, are served by the slack adapter.
 	CreateSlackAdapter() (Adapter, error)
 
 	StringToProxy(proxy string) (Proxy, error)
@@ -108,18 +127,48 @@ type Engine interface {
 	SetSecretBox(secret *SecretBox)
 	SetShadowBox(secret *ShadowBox)
 
+	// Resolver is used by the proxies without endpoints, e.g. "Demo"
+	Resolver() Resolver
+	SetResolver(r Resolver)
+
+	// The exporter of the spans of the sampled traces, nil to disable
+	// starting new traces, see SpanExporter.
+	SpanExporter() SpanExporter
+	SetSpanExporter(exp SpanExporter)
+
+	// The registry of the metrics of the engine, to which the
+	// application can add its own metrics.
+	Metrics() *metrics.Registry
+
 	SignalChannel() chan<- os.Signal
 
 	Shutdown()
 	WaitForShutdown()
 }
 
+/*
+   Resolver maps a service name to its endpoints.
+   Each endpoint is in the form "@tcp+host+port timeout=..."
+*/
+type Resolver interface {
+	Resolve(service string) ([]string, error)
+
+	// fn is called with the new endpoints when the endpoints of the service changed
+	Watch(service string, fn func(endpoints []string))
+
+	// Check the endpoints of the service again, e.g. after failing to connect
+	Refresh(service string)
+
+	Close()
+}
+
 type MethodInfo struct {
 	Name    string
 	Method  reflect.Method
 	InType  reflect.Type
 	OutType reflect.Type
 	Oneway  bool
+	Stream  bool
 }
 
 type ServantInfo struct {
@@ -152,6 +201,28 @@ type Current interface {
 	Method() string
 	Ctx() Context
 	Con() Connection
+
+	// Return a proxy to invoke the service of the callback servant
+	// on the caller side, through the same connection.
+	// The caller should add the callback servant to its slack adapter,
+	// see Engine.CreateSlackAdapter().
+	CallbackProxy(service string) (Proxy, error)
+
+	// Return a new Context with only the trace context of the quest,
+	// which should be passed to the nested invokes made by the servant,
+	// so that the trace flows into them. The trace is not propagated
+	// into the invokes without it.
+	TraceContext() Context
+
+	// Return a proxy of the same service and endpoints as prx, whose
+	// invokes carry the trace context of the quest, see TraceContext().
+	// prx itself is returned if the quest is not traced.
+	TracedProxy(prx Proxy) Proxy
+
+	// Return the context.Context of the quest, which is canceled when
+	// the client cancels the quest (see Result.Cancel()) or the
+	// connection is closed.
+	Context() context.Context
 }
 
 type Servant interface {
@@ -173,6 +244,8 @@ const (
 	LB_NORMAL LoadBalance = iota
 	LB_RANDOM
 	LB_HASH
+	LB_LEAST
+	LB_P2C
 )
 
 type Proxy interface {
@@ -197,8 +270,40 @@ type Proxy interface {
 	InvokeAsync(method string, in, out any) Result
 	InvokeCtxAsync(ctx Context, method string, in, out any) Result
 
+	// The callback is called in a new goroutine after the Result is done
+	InvokeAsyncCallback(method string, in, out any, callback func(Result)) Result
+	InvokeCtxAsyncCallback(ctx Context, method string, in, out any, callback func(Result)) Result
+
 	InvokeOneway(method string, in any) error
 	InvokeCtxOneway(ctx Context, method string, in any) error
+
+	// Send the quest to all the endpoints of the proxy in parallel,
+	// return one Result for each endpoint.
+	// outFactory returns a new out for each endpoint, see Invoke().
+	// If outFactory is nil, the answers are discarded.
+	InvokeAll(ctx Context, method string, in any, outFactory func() any) []Result
+	InvokeAllOneway(ctx Context, method string, in any) []Result
+
+	// Invoke a streaming method, see Stream.
+	// The number of partial answers buffered is XIC_STREAM in ctx,
+	// DEFAULT_STREAM_WINDOW if not specified.
+	InvokeStream(ctx Context, method string, in any) StreamResult
+
+	// Send the quests in one batch message through one connection,
+	// return one Result for each call, see BatchCall.
+	// The Results are done independently. The batch message is only
+	// used on the authenticated connections, the quests are sent
+	// individually on the others.
+	InvokeBatch(calls []BatchCall) []Result
+}
+
+// One call of Proxy.InvokeBatch(), see Invoke() for In and Out.
+// Ctx may be nil.
+type BatchCall struct {
+	Ctx Context
+	Method string
+	In any
+	Out any
 }
 
 type Connection interface {
@@ -235,11 +340,40 @@ type Result interface {
 	Service() string
 	Method() string
 	In() any
+	Endpoint() string	// empty if the quest is not sent
 
 	Wait()		// wait until out or err is set
 	Done() bool
+	DoneChan() <-chan struct{}	// closed when Done() becomes true
 
 	Out() any	// Don't call it before Wait() returns or Done() returns true
 	Err() error	// Don't call it before Wait() returns or Done() returns true
+
+	// Cancel the invoke if it is not done yet. Err() becomes
+	// QuestCanceledException and the server is told to cancel the quest.
+	Cancel()
+}
+
+type StreamResult interface {
+	Result
+
+	// Next waits for the next partial answer and decodes it into out.
+	// It returns false after all the partial answers are consumed and
+	// the final answer is received, or decoding failed. Then Err() tells
+	// how the stream ended.
+	Next(out any) bool
+}
+
+/*
+   Stream is the last argument of a streaming servant method, e.g.
+
+	func (srv *MyServant) Xic_list(cur xic.Current, in InArgs, stream xic.Stream) error
+
+   The partial answers are sent by Send(), and the final answer is sent
+   after the method returns. Send() blocks if the client has not consumed
+   enough partial answers.
+*/
+type Stream interface {
+	Send(out any) error
 }
 
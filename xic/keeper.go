@@ -35,7 +35,7 @@ type _Out_services struct {
 func (kp *_KeeperServant) Xic_services(cur Current, in _In_services, out *_Out_services) error {
 	var ap *_Adapter
 	if in.Adapter == SLACK_ADAPTER_NAME {
-		ap = kp.engine.slackAdapter
+		ap = kp.engine.getSlackAdapter()
 	} else {
 		ap = kp.engine.findAdapter(in.Adapter)
 	}
@@ -54,6 +54,60 @@ func (kp *_KeeperServant) Xic_services(cur Current, in _In_services, out *_Out_s
 	return nil
 }
 
+type _BreakerInfo struct {
+	Endpoint string			`vbs:"endpoint"`
+	State string			`vbs:"state"`
+	Trips int			`vbs:"trips"`
+}
+
+type _Out_breakers struct {
+	Proxies map[string][]_BreakerInfo	`vbs:"proxies"`
+}
+
+func (kp *_KeeperServant) Xic_breakers(cur Current, in struct{}, out *_Out_breakers) error {
+	out.Proxies = map[string][]_BreakerInfo{}
+	for _, prx := range kp.engine.getAllProxies() {
+		if infos := prx.breakerInfos(); len(infos) > 0 {
+			out.Proxies[prx.String()] = infos
+		}
+	}
+	return nil
+}
+
+type _ConnectionInfo struct {
+	Connection string		`vbs:"connection"`
+	Incoming bool			`vbs:"incoming"`
+	Endpoint string			`vbs:"endpoint,omitempty"`
+	Pending int			`vbs:"pending"`		// the quests waiting for answers
+	Waiting int			`vbs:"waiting"`		// the quests being processed
+	QueueMessages int		`vbs:"queued"`
+	QueueHigh int			`vbs:"queuedHigh"`	// the messages in the high priority lane
+	QueueBytes int			`vbs:"queuedBytes"`
+	QueueWaiters int		`vbs:"blocked"`	// the invokes blocked by the full queue
+}
+
+type _Out_connections struct {
+	Connections []_ConnectionInfo	`vbs:"connections"`
+}
+
+func (kp *_KeeperServant) Xic_connections(cur Current, in struct{}, out *_Out_connections) error {
+	cons := kp.engine.getAllConnections()
+	out.Connections = make([]_ConnectionInfo, 0, len(cons))
+	for _, con := range cons {
+		out.Connections = append(out.Connections, con.info())
+	}
+	return nil
+}
+
+type _Out_metrics struct {
+	Metrics map[string]float64	`vbs:"metrics"`
+}
+
+func (kp *_KeeperServant) Xic_metrics(cur Current, in struct{}, out *_Out_metrics) error {
+	out.Metrics = kp.engine.metrics.registry.Values()
+	return nil
+}
+
 func BuildTypeString(b *strings.Builder, t reflect.Type) {
 	if t == vbs.ReflectTypeOfDecimal64 {
 		b.WriteByte('d')
@@ -124,7 +178,9 @@ func printMethodArg(b *strings.Builder, t reflect.Type) {
 func printMethodInfo(w *strings.Builder, mi *MethodInfo) {
 	w.WriteString(mi.Name)
 	printMethodArg(w, mi.InType)
-	if !mi.Oneway {
+	if mi.Stream {
+		w.WriteString("~")
+	} else if !mi.Oneway {
 		printMethodArg(w, mi.OutType)
 	}
 }
@@ -1,4 +1,5 @@
 package xic
 
+// The default of setting xic.MaxMessageSize
 var MaxMessageSize int = 64*1024*1024
 
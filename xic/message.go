@@ -2,6 +2,7 @@ package xic
 
 import (
 	"bytes"
+	"context"
 	"math"
 	"encoding/binary"
 
@@ -17,20 +18,24 @@ const (
 	CheckMsgType	     = 'C'
 	HelloMsgType         = 'H'
 	ByeMsgType           = 'B'
+	BatchQuestMsgType    = 'q'
+	BatchAnswerMsgType   = 'a'
 )
 
 const MsgHeaderSize = 8
 
 const (
 	FLAG_CIPHER = 0x02
-	FLAG_MASK = FLAG_CIPHER
+	FLAG_COMPRESS = 0x04
+	FLAG_MORE = 0x08	// more fragments of the message follow
+	FLAG_MASK = FLAG_CIPHER | FLAG_COMPRESS | FLAG_MORE
 )
 
 type _MessageHeader struct {
 	Magic    byte		// 'X'
 	Version  byte		// '!'
-	Type     MsgType        // 'Q', 'A', 'H', 'B', 'C'
-	Flags    byte           // 0x00 or 0x02
+	Type     MsgType        // 'Q', 'A', 'H', 'B', 'C', 'q', 'a'
+	Flags    byte           // 0x00 or FLAG_CIPHER | FLAG_COMPRESS | FLAG_MORE
 	BodySize int32          // in big endian byte order
 }
 
@@ -109,6 +114,7 @@ func (m _ByeMessage) Bytes() []byte {
 
 type _OutCheck struct {
 	buf []byte
+	normal bool	// in the normal lane, see isHighPriority()
 }
 
 var _ _OutMessage = (*_OutCheck)(nil)
@@ -140,13 +146,17 @@ type _OutQuest struct {
 	reserved int
 	start    int
 	buf      []byte
+	pbuf     *bytes.Buffer	// from the pool, see release()
+	high     bool		// of high priority, see OutMsgQueue
+	keeper   bool		// of the keeper service, not limited by the queue
 }
 
 var _ _OutMessage = (*_OutQuest)(nil)
 
 func newOutQuest(txid int64, service, method string, ctx Context, args any) *_OutQuest {
-	q := &_OutQuest{txid: txid, start: -1}
-	b := &bytes.Buffer{}
+	keeper := service == "\x00"
+	q := &_OutQuest{txid: txid, start: -1, high: keeper || ctxHighPriority(ctx), keeper: keeper}
+	b := getOutBuffer()
 	enc := vbs.NewEncoder(b)
 	b.Write(commonHeaderBytes[:])
 	enc.Encode(math.MaxInt64)
@@ -160,6 +170,7 @@ func newOutQuest(txid int64, service, method string, ctx Context, args any) *_Ou
 		panic("vbs.Encoder error")
 	}
 	q.buf = b.Bytes()
+	q.pbuf = b
 	return q
 }
 
@@ -183,6 +194,15 @@ func (q *_OutQuest) Bytes() []byte {
 	return q.buf[q.start:]
 }
 
+// Called after the quest is written, the quest can't be used any more
+func (q *_OutQuest) release() {
+	if q.pbuf != nil {
+		putOutBuffer(q.pbuf)
+		q.pbuf = nil
+		q.buf = nil
+	}
+}
+
 func (q *_OutQuest) SetTxid(txid int64) {
 	if q.txid != 0 {
 		q.txid = txid
@@ -192,40 +212,64 @@ func (q *_OutQuest) SetTxid(txid int64) {
 
 type _OutAnswer struct {
 	txid     int64
+	status   int
+	partial  bool
 	reserved int
+	argsOff  int
 	start    int
 	buf      []byte
+	pbuf     *bytes.Buffer	// from the pool, see release()
+	high     bool		// of high priority, see OutMsgQueue
 }
 
 var _ _OutMessage = (*_OutAnswer)(nil)
 
-func newOutAnswer(normal bool, txid int64, args any) *_OutAnswer {
-	a := &_OutAnswer{txid:txid, start: -1}
-	b := &bytes.Buffer{}
+func newOutAnswer(status int, txid int64, args any) *_OutAnswer {
+	a := &_OutAnswer{txid:txid, status:status, partial: status == answer_PARTIAL, start: -1}
+	b := getOutBuffer()
 	enc := vbs.NewEncoder(b)
 	b.Write(commonHeaderBytes[:])
 	enc.Encode(math.MaxInt64)
 	a.reserved = b.Len()
 
-        if normal {
-                enc.Encode(0)
-        } else {
-                enc.Encode(-1)
-        }
+	enc.Encode(status)
+	a.argsOff = b.Len()
 	err := enc.Encode(args)
 	if err != nil {
 		panic("vbs.Encoder error")
 	}
 	a.buf = b.Bytes()
+	a.pbuf = b
+	return a
+}
+
+// args is the VBS encoded arguments
+func newOutAnswerBytes(status int, txid int64, args []byte) *_OutAnswer {
+	a := &_OutAnswer{txid:txid, status:status, partial: status == answer_PARTIAL, start: -1}
+	b := getOutBuffer()
+	enc := vbs.NewEncoder(b)
+	b.Write(commonHeaderBytes[:])
+	enc.Encode(math.MaxInt64)
+	a.reserved = b.Len()
+
+	enc.Encode(status)
+	a.argsOff = b.Len()
+	b.Write(args)
+	a.buf = b.Bytes()
+	a.pbuf = b
 	return a
 }
 
 func newOutAnswerNormal(txid int64, args any) *_OutAnswer {
-	return newOutAnswer(true, txid, args)
+	return newOutAnswer(answer_NORMAL, txid, args)
 }
 
 func newOutAnswerExceptional(txid int64, args any) *_OutAnswer {
-	return newOutAnswer(false, txid, args)
+	return newOutAnswer(answer_EXCEPTION, txid, args)
+}
+
+func newOutAnswerPartial(txid int64, args any) *_OutAnswer {
+	return newOutAnswer(answer_PARTIAL, txid, args)
 }
 
 func (a *_OutAnswer) Type() MsgType {
@@ -248,6 +292,15 @@ func (a *_OutAnswer) Bytes() []byte {
 	return a.buf[a.start:]
 }
 
+// Called after the answer is written, the answer can't be used any more
+func (a *_OutAnswer) release() {
+	if a.pbuf != nil {
+		putOutBuffer(a.pbuf)
+		a.pbuf = nil
+		a.buf = nil
+	}
+}
+
 func (a *_OutAnswer) SetTxid(txid int64) {
 	if a.txid != 0 {
 		a.txid = txid
@@ -258,30 +311,40 @@ func (a *_OutAnswer) SetTxid(txid int64) {
 type _InMsg struct {
 	argsOff int
 	buf     []byte
+	pooled  bool	// buf is from the pool, and returned after decoding the arguments
 }
 
+// If the buffer is pooled, DecodeArgs can be called only once.
 func (m *_InMsg) DecodeArgs(args any) error {
-	dec := vbs.NewDecoderBytes(m.buf[m.argsOff:], true)
+	if m.pooled && m.buf == nil {
+		return xerr.Errorf("Arguments already decoded")
+	}
+	// The decoder must copy the blobs out of the pooled buffer
+	dec := vbs.NewDecoderBytes(m.buf[m.argsOff:], !m.pooled)
 	err := dec.Decode(args)
-	if err != nil {
-		return err
-	} else if dec.More() {
-		return xerr.Errorf("Surplus bytes left after decoding arguments")
+	if err == nil && dec.More() {
+		err = xerr.Errorf("Surplus bytes left after decoding arguments")
 	}
-	return nil
+	if m.pooled {
+		putInBuffer(m.buf)
+		m.buf = nil
+	}
+	return err
 }
 
 type _InCheck struct {
 	_InMsg
 	cmd string
+	encrypted bool	// received with FLAG_CIPHER
 }
 
-func newInCheck(buf []byte) *_InCheck {
+func newInCheck(buf []byte, pooled bool) *_InCheck {
 	c := &_InCheck{}
-	dec := vbs.NewDecoderBytes(buf, true)
+	dec := vbs.NewDecoderBytes(buf, !pooled)
 	dec.Decode(&c.cmd)
 	c.argsOff = dec.Size()
 	c.buf = buf
+	c.pooled = pooled
 	return c
 }
 
@@ -295,17 +358,22 @@ type _InQuest struct {
 	service string
 	method  string
 	ctx     Context
+	high    bool	// of high priority, see questHighPriority()
+	batch   *_BatchAnswer	// nil if not in a batch
+	cctx    context.Context		// see startQuestContext()
+	cancel  context.CancelFunc
 }
 
-func newInQuest(buf []byte) *_InQuest {
+func newInQuest(buf []byte, pooled bool) *_InQuest {
 	q := &_InQuest{}
-	dec := vbs.NewDecoderBytes(buf, true)
+	dec := vbs.NewDecoderBytes(buf, !pooled)
 	dec.Decode(&q.txid)
 	dec.Decode(&q.service)
 	dec.Decode(&q.method)
 	dec.Decode(&q.ctx)
 	q.argsOff = dec.Size()
 	q.buf = buf
+	q.pooled = pooled
 	return q
 }
 
@@ -319,13 +387,14 @@ type _InAnswer struct {
 	_InMsg
 }
 
-func newInAnswer(buf []byte) *_InAnswer {
+func newInAnswer(buf []byte, pooled bool) *_InAnswer {
 	a := &_InAnswer{}
-	dec := vbs.NewDecoderBytes(buf, true)
+	dec := vbs.NewDecoderBytes(buf, !pooled)
 	dec.Decode(&a.txid)
 	dec.Decode(&a.status)
 	a.argsOff = dec.Size()
 	a.buf = buf
+	a.pooled = pooled
 	return a
 }
 
@@ -334,6 +403,11 @@ func (a *_InAnswer) Type() MsgType {
 }
 
 func DecodeMessage(header _MessageHeader, buf []byte) (_Message, error) {
+	return decodeMessage(header, buf, false)
+}
+
+// If pooled is true, buf is from getInBuffer() and owned by the message
+func decodeMessage(header _MessageHeader, buf []byte, pooled bool) (_Message, error) {
 	if header.Magic != 'X' || header.Version != '!' {
 		return nil, xerr.Errorf("Unknown message Magic(%d) and Version(%d)", header.Magic, header.Version)
 	}
@@ -346,11 +420,13 @@ func DecodeMessage(header _MessageHeader, buf []byte) (_Message, error) {
 	var msg _Message
 	switch header.Type {
 	case QuestMsgType:
-		msg = newInQuest(buf)
+		msg = newInQuest(buf, pooled)
 	case AnswerMsgType:
-		msg = newInAnswer(buf)
+		msg = newInAnswer(buf, pooled)
 	case CheckMsgType:
-		msg = newInCheck(buf)
+		msg = newInCheck(buf, pooled)
+	case BatchQuestMsgType, BatchAnswerMsgType:
+		return newInBatch(header.Type, buf, pooled)
 	case HelloMsgType:
 		msg = theHelloMessage
 	case ByeMsgType:
@@ -0,0 +1,148 @@
+package xic
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"halftwo/mangos/dlog"
+	"halftwo/mangos/metrics"
+)
+
+/*
+   The metrics of the engine are served in the Prometheus text format
+   at http://<xic.metrics.listen>/metrics if xic.metrics.listen is set,
+   e.g. "127.0.0.1:9100", and by the method "metrics" of the keeper service.
+*/
+type _Metrics struct {
+	registry *metrics.Registry
+
+	questsServed *metrics.Counter
+	questDuration *metrics.Histogram
+	answersReceived *metrics.Counter
+	invokeLatency *metrics.Histogram
+	exceptionsSent *metrics.CounterVec
+	exceptionsReceived *metrics.CounterVec
+	handshakeFailures *metrics.Counter
+	bytesSent *metrics.Counter
+	bytesReceived *metrics.Counter
+}
+
+func newMetrics(engine *_Engine) *_Metrics {
+	r := metrics.NewRegistry()
+	m := &_Metrics{registry:r}
+	m.questsServed = r.NewCounter("xic_quests_served_total", "The number of quests served")
+	m.questDuration = r.NewHistogram("xic_quest_duration_seconds", "The duration of serving the twoway quests", nil)
+	m.answersReceived = r.NewCounter("xic_answers_received_total", "The number of answers received")
+	m.invokeLatency = r.NewHistogram("xic_invoke_latency_seconds", "The latency of the twoway invokes answered", nil)
+	m.exceptionsSent = r.NewCounterVec("xic_exceptions_sent_total", "The number of exceptions answered", "name")
+	m.exceptionsReceived = r.NewCounterVec("xic_exceptions_received_total", "The number of exceptions received", "name")
+	m.handshakeFailures = r.NewCounter("xic_handshake_failures_total", "The number of connections failed to handshake")
+	m.bytesSent = r.NewCounter("xic_bytes_sent_total", "The number of bytes written to the connections")
+	m.bytesReceived = r.NewCounter("xic_bytes_received_total", "The number of bytes read from the connections")
+
+	r.NewGaugeFunc("xic_quests_waiting", "The number of quests being served", func() float64 {
+		return float64(engine.numQ.Load())
+	})
+	r.NewGaugeFunc("xic_connections", "The number of live connections", func() float64 {
+		return float64(len(engine.getAllConnections()))
+	})
+	r.NewGaugeFunc("xic_quests_pending", "The number of invokes waiting for answers", func() float64 {
+		return engine.sumConnections(func(ci *_ConnectionInfo) int { return ci.Pending })
+	})
+	r.NewGaugeFunc("xic_queue_messages", "The number of messages in the outgoing queues", func() float64 {
+		return engine.sumConnections(func(ci *_ConnectionInfo) int { return ci.QueueMessages })
+	})
+	r.NewGaugeFunc("xic_queue_bytes", "The number of bytes in the outgoing queues", func() float64 {
+		return engine.sumConnections(func(ci *_ConnectionInfo) int { return ci.QueueBytes })
+	})
+	return m
+}
+
+func (engine *_Engine) sumConnections(fn func(ci *_ConnectionInfo) int) float64 {
+	sum := 0
+	for _, con := range engine.getAllConnections() {
+		ci := con.info()
+		sum += fn(&ci)
+	}
+	return float64(sum)
+}
+
+func exceptionName(err error) string {
+	if ex, ok := err.(Exception); ok {
+		return string(ex.Name())
+	}
+	return string(UnknownException)
+}
+
+func (m *_Metrics) questServed(start time.Time, twoway bool, err error) {
+	m.questsServed.Inc()
+	if twoway {
+		m.questDuration.Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		m.exceptionsSent.With(exceptionName(err)).Inc()
+	}
+}
+
+// The exceptions of xic, other names received are counted as "other"
+var knownExNames = map[string]bool{
+	string(ProtocolException): true,
+	string(ConnectionClosedException): true,
+	string(QuestNotServedException): true,
+	string(QuestCanceledException): true,
+	string(UnknownException): true,
+	string(ServiceNotFoundException): true,
+	string(MethodNotFoundException): true,
+	string(AdapterAbsentException): true,
+	string(ConnectionOverloadException): true,
+	string(EngineOverloadException): true,
+	string(AuthFailedException): true,
+	string(InvalidParameterException): true,
+	string(NoEndpointException): true,
+	string(CircuitOpenException): true,
+	string(InjectedFaultException): true,
+	string(MessageSizeException): true,
+}
+
+// The exname is sent by the peer, so the label is limited to the known
+// names to keep the number of series bounded.
+func exceptionLabel(exname string) string {
+	if knownExNames[exname] {
+		return exname
+	}
+	return "other"
+}
+
+func (m *_Metrics) answerReceived(res *_Result, exname string) {
+	m.answersReceived.Inc()
+	m.invokeLatency.Observe(time.Since(res.start).Seconds())
+	if exname != "" {
+		m.exceptionsReceived.With(exceptionLabel(exname)).Inc()
+	}
+}
+
+func (engine *_Engine) Metrics() *metrics.Registry {
+	return engine.metrics.registry
+}
+
+// Return nil if xic.metrics.listen is not set
+func (engine *_Engine) startMetricsServer() *http.Server {
+	addr := engine.setting.Get("xic.metrics.listen")
+	if addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		dlog.Allog(dlog.Id(), "XIC.WARN", "", "Failed to listen xic.metrics.listen %#v --- %s", addr, err.Error())
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", engine.metrics.registry.Handler())
+	server := &http.Server{Handler:mux}
+	go server.Serve(l)
+	dlog.Allog(dlog.Id(), "XIC.INFO", "", "Serving metrics at http://%s/metrics", l.Addr().String())
+	return server
+}
@@ -0,0 +1,14 @@
+package xic
+
+import (
+	"testing"
+)
+
+func TestExceptionLabel(t *testing.T) {
+	if l := exceptionLabel(string(ServiceNotFoundException)); l != string(ServiceNotFoundException) {
+		t.Errorf("Wrong label %#v of known exception", l)
+	}
+	if l := exceptionLabel("Random\x01Exception"); l != "other" {
+		t.Errorf("Wrong label %#v of unknown exception", l)
+	}
+}
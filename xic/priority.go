@@ -0,0 +1,73 @@
+package xic
+
+import (
+	"strings"
+)
+
+/*
+   The outgoing queue of a connection has two lanes, and the messages in
+   the high priority lane are sent before those in the normal lane.
+   The quests with XIC_PRIORITY > 0 in the Context, the quests of the
+   keeper service (e.g. the health checks) and the check messages are of
+   high priority. On the server, the methods listed in xic.priority.methods,
+   e.g. "Demo::ping Admin::*", are also of high priority.
+
+   Their answers are sent in the high priority lane too.
+
+   XIC_PRIORITY is set by the clients, so it affects only the order of the
+   messages. Only the privileged quests bypass the limits: the quests of
+   the keeper service are queued even if the outgoing queue is full (see
+   xic.queue.messages), and the quests of the keeper service and the
+   methods in xic.priority.methods are served even if the engine or the
+   connection is overloaded (see xic.maxQ).
+*/
+
+// Return true if XIC_PRIORITY in ctx is greater than 0
+func ctxHighPriority(ctx Context) bool {
+	switch v := ctx["XIC_PRIORITY"].(type) {
+	case int64:
+		return v > 0
+	case int:
+		return v > 0
+	case int32:
+		return v > 0
+	}
+	return false
+}
+
+func isHighPriority(msg _OutMessage) bool {
+	switch m := msg.(type) {
+	case *_OutQuest:
+		return m.high
+	case *_OutAnswer:
+		return m.high
+	case *_OutCheck:
+		return !m.normal
+	}
+	return false
+}
+
+// The names are in the form "<service>::<method>" or "<service>::*"
+func parsePriorityMethods(s string) map[string]bool {
+	var methods map[string]bool
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if methods == nil {
+			methods = make(map[string]bool)
+		}
+		methods[name] = true
+	}
+	return methods
+}
+
+// The quests of the keeper service and xic.priority.methods
+func (engine *_Engine) questPrivileged(quest *_InQuest) bool {
+	if quest.service == "\x00" {
+		return true
+	}
+	pm := engine.priorityMethods
+	return pm != nil && (pm[quest.service + "::" + quest.method] || pm[quest.service + "::*"])
+}
+
+func (engine *_Engine) questHighPriority(quest *_InQuest) bool {
+	return ctxHighPriority(quest.ctx) || engine.questPrivileged(quest)
+}
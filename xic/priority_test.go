@@ -0,0 +1,81 @@
+package xic
+
+import (
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	var q OutMsgQueue
+	normal := newOutQuest(1, "Demo", "echo", Context{}, struct{}{})
+	high := newOutQuest(2, "Demo", "echo", Context{"XIC_PRIORITY":1}, struct{}{})
+	keeper := newOutQuest(3, "\x00", "adapters", Context{}, struct{}{})
+	answer := newOutAnswerNormal(4, struct{}{})
+	check := newOutCheck(ck_CREDIT, &_CreditArgs{Txid:5, Num:1})
+	if normal.high || !high.high || !keeper.high || isHighPriority(answer) || !isHighPriority(check) {
+		t.Fatalf("Wrong priority of messages")
+	}
+	if high.keeper || !keeper.keeper {
+		t.Fatalf("Only the keeper quests bypass the queue limits")
+	}
+
+	q.PushBack(normal)
+	q.PushBack(answer)
+	q.PushBack(high)
+	q.PushBack(keeper)
+	q.PushBack(check)
+	if q.Num() != 5 || q.NumHigh() != 3 {
+		t.Fatalf("Wrong OutMsgQueue num=%d high=%d", q.Num(), q.NumHigh())
+	}
+	for i, m := range []_OutMessage{high, keeper, check, normal, answer} {
+		if q.PopFront() != m {
+			t.Fatalf("Wrong order of OutMsgQueue at %d", i)
+		}
+	}
+	if q.Num() != 0 || q.Bytes() != 0 {
+		t.Fatalf("Bug in OutMsgQueue")
+	}
+
+	engine := &_Engine{priorityMethods:parsePriorityMethods("Demo::ping, Admin::*")}
+	for _, c := range []struct{
+		quest _InQuest
+		high bool
+		privileged bool
+	}{
+		{_InQuest{service:"Demo", method:"ping"}, true, true},
+		{_InQuest{service:"Demo", method:"echo"}, false, false},
+		{_InQuest{service:"Admin", method:"reload"}, true, true},
+		{_InQuest{service:"\x00", method:"adapters"}, true, true},
+		{_InQuest{service:"Demo", method:"echo", ctx:Context{"XIC_PRIORITY":int64(1)}}, true, false},
+		{_InQuest{service:"Demo", method:"echo", ctx:Context{"XIC_PRIORITY":int64(0)}}, false, false},
+	} {
+		if engine.questHighPriority(&c.quest) != c.high || engine.questPrivileged(&c.quest) != c.privileged {
+			t.Errorf("Wrong priority of %s::%s", c.quest.service, c.quest.method)
+		}
+	}
+}
+
+func TestPriorityOverload(t *testing.T) {
+	setting := NewSetting()
+	setting.Set("xic.priority.methods", "Demo::ping")
+	engine := newEngineSetting(setting)
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+	con := _newConnection(engine, true)
+	con.state = con_ACTIVE
+	con.maxQ = 1
+	con.numQ.Add(1)
+
+	// XIC_PRIORITY doesn't bypass the overload check
+	for _, c := range []struct{
+		quest _InQuest
+		doable bool
+	}{
+		{_InQuest{txid:1, service:"Demo", method:"echo", ctx:Context{"XIC_PRIORITY":int64(1)}}, false},
+		{_InQuest{txid:2, service:"Demo", method:"ping", ctx:Context{}}, true},
+		{_InQuest{txid:3, service:"\x00", method:"adapters", ctx:Context{}}, true},
+	} {
+		if con.check_doable(&c.quest) != c.doable {
+			t.Errorf("Wrong check_doable() of %s::%s", c.quest.service, c.quest.method)
+		}
+	}
+}
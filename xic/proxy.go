@@ -24,8 +24,15 @@ type _Proxy struct {
 	ctx     atomic.Value // Context
 	cons    []*_Connection
 	endpoints []string
+	weights []uint32	// nil if all the endpoints have the same weight
+	healths []*_Health
+	breakers []*_Breaker
+	breaker *_BreakerPolicy	// nil if not specified in the proxy string
+	probing bool
+	released bool	// see release()
 	idx	int
         cseq    carp.Carp
+	mutex	sync.Mutex	// protects cons, endpoints, healths, breakers, idx, cseq and released
 }
 
 func (lb LoadBalance) String() string {
@@ -36,11 +43,15 @@ func (lb LoadBalance) String() string {
 		return "-lb:random"
 	case LB_NORMAL:
 		return "-lb:normal"
+	case LB_LEAST:
+		return "-lb:least"
+	case LB_P2C:
+		return "-lb:p2c"
 	}
 	return ""
 }
 
-func newProxy(engine *_Engine, proxy string) *_Proxy {
+func newProxy(engine *_Engine, proxy string, resolver Resolver) *_Proxy {
 	sp := xstr.NewSplitter(proxy, "@")
 	tk := xstr.NewTokenizerSpace(sp.Next())
 
@@ -57,16 +68,27 @@ func newProxy(engine *_Engine, proxy string) *_Proxy {
 			prx.lb = LB_RANDOM
 		case s == "-lb:normal":
 			prx.lb = LB_NORMAL
+		case s == "-lb:least":
+			prx.lb = LB_LEAST
+		case s == "-lb:p2c":
+			prx.lb = LB_P2C
+		case strings.HasPrefix(s, "-cb:"):
+			if bp, ok := parseBreakerOption(s, engine.breaker); ok {
+				prx.breaker = bp
+			} else {
+				dlog.Log("XIC.WARN", "Invalid circuit breaker option %#v of proxy %#v", s, proxy)
+			}
 		}
 	}
 
+	var endpoints []string
 	for sp.HasMore() {
 		endpoint := sp.Next()
 		ep, err := parseEndpoint(endpoint)
 		if err != nil {
 			continue
 		}
-		prx.endpoints = append(prx.endpoints, ep.String())
+		endpoints = append(endpoints, ep.String())
 	}
 
 	bd := &strings.Builder{}
@@ -75,24 +97,177 @@ func newProxy(engine *_Engine, proxy string) *_Proxy {
 		bd.WriteByte(' ')
 		bd.WriteString(prx.lb.String())
 	}
+	if prx.breaker != nil {
+		bd.WriteByte(' ')
+		bd.WriteString(prx.breaker.String())
+	}
 
-	if len(prx.endpoints) > 0 {
-		for _, ep := range prx.endpoints {
+	if len(endpoints) > 0 {
+		for _, ep := range endpoints {
 			bd.WriteByte(' ')
 			bd.WriteString(ep)
 		}
+	} else if resolver != nil {
+		// Only the service name is given, get the endpoints from the resolver
+		var err error
+		endpoints, err = resolver.Resolve(service)
+		if err != nil {
+			dlog.Log("XIC.WARN", "Failed to resolve service %#v: %s", service, err.Error())
+		}
+		resolver.Watch(service, prx.setEndpoints)
 	}
-	prx.cons = make([]*_Connection, len(prx.endpoints))
 	prx.str = bd.String()
+	added, _ := prx._set_endpoints(endpoints)
+	engine.refEndpoints(added)
+	return prx
+}
+
+// Called with prx.mutex locked, or before the proxy is used.
+// Return the added and the removed endpoints, see engine.refEndpoints().
+func (prx *_Proxy) _set_endpoints(endpoints []string) (added, removed []string) {
+	cons := make([]*_Connection, len(endpoints))
+	healths := make([]*_Health, len(endpoints))
+	breakers := make([]*_Breaker, len(endpoints))
+	for i, ep := range prx.endpoints {
+		k := indexString(endpoints, ep)
+		if k < 0 {
+			removed = append(removed, ep)
+		} else {
+			cons[k] = prx.cons[i]
+			healths[k] = prx.healths[i]
+			breakers[k] = prx.breakers[i]
+		}
+	}
+	for _, ep := range endpoints {
+		if indexString(prx.endpoints, ep) < 0 {
+			added = append(added, ep)
+		}
+	}
+
+	policy := prx.breaker
+	if policy == nil {
+		policy = prx.engine.breaker
+	}
+	for k := range endpoints {
+		if healths[k] == nil {
+			healths[k] = newHealth(prx.engine.health, prx.service, endpoints[k])
+		}
+		if breakers[k] == nil {
+			breakers[k] = newBreaker(policy, prx.service, endpoints[k])
+		}
+	}
 
-        if prx.lb == LB_HASH {
-		members := make([]uint64, len(prx.endpoints))
-		for i := 0; i < len(prx.endpoints); i++ {
-			members[i] = Crc64Checksum([]byte(prx.endpoints[i]))
+	if prx.idx < len(prx.endpoints) {
+		prx.idx = indexString(endpoints, prx.endpoints[prx.idx])
+	}
+	if prx.idx < 0 || prx.idx >= len(endpoints) {
+		prx.idx = 0
+	}
+	prx.endpoints = endpoints
+	prx.cons = cons
+	prx.healths = healths
+	prx.breakers = breakers
+
+	prx.weights = nil
+	weights := make([]uint32, len(endpoints))
+	for i, ep := range endpoints {
+		weights[i] = 1
+		if ei, err := parseEndpoint(ep); err == nil {
+			weights[i] = ei.Weight()
+		}
+		if weights[i] != weights[0] {
+			prx.weights = weights
+		}
+	}
+
+	prx.cseq = nil
+        if prx.lb == LB_HASH && len(endpoints) > 0 {
+		members := make([]uint64, len(endpoints))
+		for i := 0; i < len(endpoints); i++ {
+			members[i] = Crc64Checksum([]byte(endpoints[i]))
+		}
+		if prx.weights != nil {
+			prx.cseq = carp.NewCarpWeight(members, prx.weights, nil)
+		} else {
+			prx.cseq = carp.NewCarp(members, nil)
 		}
-                prx.cseq = carp.NewCarp(members, nil)
         }
-	return prx
+	return
+}
+
+func (prx *_Proxy) weight(k int) int {
+	if prx.weights == nil {
+		return 1
+	}
+	return int(prx.weights[k])
+}
+
+func (prx *_Proxy) randomIndex() int {
+	if prx.weights == nil {
+		return rand.Intn(len(prx.endpoints))
+	}
+
+	sum := 0
+	for _, w := range prx.weights {
+		sum += int(w)
+	}
+	n := rand.Intn(sum)
+	for i, w := range prx.weights {
+		n -= int(w)
+		if n < 0 {
+			return i
+		}
+	}
+	return len(prx.weights) - 1
+}
+
+func indexString(ss []string, s string) int {
+	for i, x := range ss {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Called by the resolver when the endpoints of the service changed
+// Release the endpoints of the proxy not used, see StringToProxy().
+// The endpoints changed by the resolver later are ignored.
+func (prx *_Proxy) release() {
+	prx.mutex.Lock()
+	prx.released = true
+	endpoints := prx.endpoints
+	prx.mutex.Unlock()
+
+	for _, ep := range endpoints {
+		prx.engine.dropConnection(ep)
+	}
+}
+
+func (prx *_Proxy) setEndpoints(endpoints []string) {
+	var eps []string
+	for _, endpoint := range endpoints {
+		ei, err := parseEndpoint(endpoint)
+		if err != nil {
+			dlog.Log("XIC.WARN", "Invalid endpoint %#v of service %#v: %s", endpoint, prx.service, err.Error())
+			continue
+		}
+		eps = append(eps, ei.String())
+	}
+
+	prx.mutex.Lock()
+	if prx.released {
+		prx.mutex.Unlock()
+		return
+	}
+	added, removed := prx._set_endpoints(eps)
+	prx.mutex.Unlock()
+
+	dlog.Log("XIC.INFO", "Endpoints of proxy %#v changed to %v", prx.str, eps)
+	prx.engine.refEndpoints(added)
+	for _, ep := range removed {
+		prx.engine.dropConnection(ep)
+	}
 }
 
 func newProxyWithConnection(engine *_Engine, service string, con *_Connection) *_Proxy {
@@ -116,11 +291,9 @@ func (prx *_Proxy) String() string {
 }
 
 func (prx *_Proxy) Endpoints() string {
-	k := strings.IndexByte(prx.str, '@')
-	if k < 0 {
-		return ""
-	}
-	return prx.str[k:]
+	prx.mutex.Lock()
+	defer prx.mutex.Unlock()
+	return strings.Join(prx.endpoints, " ")
 }
 
 func (prx *_Proxy) Context() Context {
@@ -141,30 +314,58 @@ func (prx *_Proxy) LoadBalance() LoadBalance {
 func (prx *_Proxy) TimedProxy(timeout, closeTimeout, connectTimeout int) Proxy {
 	// TODO
 	panic("Not implemented")
-	var prx2 Proxy
-	return prx2
-}
-
-func (prx *_Proxy) pick_random() (con *_Connection, err error) {
-        num := len(prx.cons)
-        k := rand.Intn(num)
-        con = prx.cons[k]
-        // TODO: eleminate error connection
-        if con == nil || !con.IsLive() {
-                con, err = prx.engine.makeConnection(prx.service, prx.endpoints[k])
-                if err != nil {
-                        return
-                }
-                prx.cons[k] = con
-        }
-        return
 }
 
-func (prx *_Proxy) pick_hash(ctx Context) (con *_Connection, err error) {
+// Return the connection of the k-th endpoint, make one if necessary
+func (prx *_Proxy) connectionAt(k int) (*_Connection, error) {
+	con := prx.cons[k]
+	if con == nil || !con.IsLive() {
+		var err error
+		con, err = prx.engine.makeConnection(prx.service, prx.endpoints[k])
+		if err != nil {
+			return nil, err
+		}
+		prx.cons[k] = con
+	}
+	return con, nil
+}
+
+func (prx *_Proxy) usable(k int, now time.Time) bool {
+	if prx.healths == nil {
+		return true
+	}
+	return !prx.healths[k].ejected(now) && prx.breakers[k].allow(now, false)
+}
+
+func (prx *_Proxy) pick_random(now time.Time) int {
+	sum := 0
+	for k := range prx.endpoints {
+		if prx.usable(k, now) {
+			sum += prx.weight(k)
+		}
+	}
+	if sum == 0 {
+		// all ejected
+		return prx.randomIndex()
+	}
+
+	n := rand.Intn(sum)
+	for k := range prx.endpoints {
+		if prx.usable(k, now) {
+			n -= prx.weight(k)
+			if n < 0 {
+				return k
+			}
+		}
+	}
+	return len(prx.endpoints) - 1
+}
+
+func (prx *_Proxy) pick_hash(ctx Context, now time.Time) int {
         xichint := ctx.Get("XIC_HINT")
 	if xichint == nil {
 		dlog.Log("XIC.WARN", "XIC_HINT not specified in context")
-		return prx.pick_normal()
+		return prx.pick_normal(now)
 	}
 
         var hint uint32
@@ -180,62 +381,171 @@ func (prx *_Proxy) pick_hash(ctx Context) (con *_Connection, err error) {
                 hint = Crc32Checksum([]byte(s))
 	default:
 		dlog.Log("XIC.WARN", "XIC_HINT invalid in context")
-		return prx.pick_normal()
+		return prx.pick_normal(now)
         }
 
-	k := prx.cseq.Which(hint)
-	con = prx.cons[k]
-	if con == nil || !con.IsLive() {
-                con, err = prx.engine.makeConnection(prx.service, prx.endpoints[k])
-                if err != nil {
-                        return
-                }
-                prx.cons[k] = con
-		return
+	// The first usable one in the sequence of preference
+	seqs := prx.cseq.Sequence(hint, make([]int, len(prx.endpoints)))
+	for _, k := range seqs {
+		if prx.usable(k, now) {
+			return k
+		}
 	}
+	return seqs[0]
+}
 
-	/*
-        var seqs [5]int
-	ss := prx.cseq.Sequence(hint, seqs[:])
-	*/
-	// TODO
-	return nil, xerr.Errorf("Not Implemented")
+// The latency of the endpoint without latency samples, and the minimum
+// latency used in the cost, so that the cost still grows with the pending
+// invokes of a new endpoint or a very fast one.
+const _MIN_COST_LATENCY = time.Millisecond
+
+// The cost of an endpoint is its average latency multiplied by the number
+// of pending invokes plus one, divided by its weight. The endpoint without
+// latency samples has a low cost, so that it will be tried soon.
+func (prx *_Proxy) cost(k int) float64 {
+	pending := 0
+	if con := prx.cons[k]; con != nil && con.IsLive() {
+		pending = con.numPending()
+	}
+	latency := prx.healths[k].Latency()
+	if latency < _MIN_COST_LATENCY {
+		latency = _MIN_COST_LATENCY
+	}
+	return float64(latency) * float64(pending + 1) / float64(prx.weight(k))
 }
 
-func (prx *_Proxy) pick_normal() (*_Connection, error) {
-	con := prx.cons[prx.idx]
-	if con == nil || !con.IsLive() {
-		if prx.fixed {
-			return nil, xerr.Errorf("Broken connection of fixed proxy")
+func (prx *_Proxy) pick_least(now time.Time) int {
+	num := len(prx.endpoints)
+	best := -1
+	bestCost := 0.0
+	// Start from a random one, so that the ties are broken randomly
+	start := rand.Intn(num)
+	for i := 0; i < num; i++ {
+		k := (start + i) % num
+		if !prx.usable(k, now) {
+			continue
 		}
-
-		prx.idx++
-		if prx.idx >= len(prx.endpoints) {
-			prx.idx = 0
+		c := prx.cost(k)
+		if best < 0 || c < bestCost {
+			best = k
+			bestCost = c
 		}
-		var err error
-		con, err = prx.engine.makeConnection(prx.service, prx.endpoints[prx.idx])
-		if err != nil {
-			return con, err
+	}
+
+	if best < 0 {
+		// all ejected
+		return start
+	}
+	return best
+}
+
+// Power of two choices, pick two endpoints randomly and use the one with less cost
+func (prx *_Proxy) pick_p2c(now time.Time) int {
+	a := prx.pick_random(now)
+	b := a
+	for i := 0; i < 3 && b == a; i++ {
+		b = prx.pick_random(now)
+	}
+	if b != a && prx.cost(b) < prx.cost(a) {
+		return b
+	}
+	return a
+}
+
+func (prx *_Proxy) pick_normal(now time.Time) int {
+	con := prx.cons[prx.idx]
+	if con != nil && con.IsLive() && prx.usable(prx.idx, now) {
+		return prx.idx
+	}
+
+	num := len(prx.endpoints)
+	for i := 1; i <= num; i++ {
+		k := (prx.idx + i) % num
+		if prx.usable(k, now) {
+			prx.idx = k
+			return k
 		}
-		prx.cons[prx.idx] = con
 	}
-	return con, nil
+
+	// all ejected
+	prx.idx = (prx.idx + 1) % num
+	return prx.idx
 }
 
-func (prx *_Proxy) pickConnection(ctx Context) (*_Connection, error) {
+// The returned _Health and _Breaker are nil for the fixed proxy
+func (prx *_Proxy) pickConnection(ctx Context) (*_Connection, *_Health, *_Breaker, error) {
+	prx.mutex.Lock()
+	defer prx.mutex.Unlock()
+	if prx.fixed {
+		con := prx.cons[0]
+		if !con.IsLive() {
+			return nil, nil, nil, xerr.Errorf("Broken connection of fixed proxy")
+		}
+		return con, nil, nil, nil
+	}
+
+	if len(prx.cons) == 0 {
+		return nil, nil, nil, newExf(NoEndpointException, "service=%#v", prx.service)
+	}
+
+	var k int
+	now := time.Now()
 	if prx.lb == LB_NORMAL || len(prx.cons) == 1 {
-		return prx.pick_normal()
+		k = prx.pick_normal(now)
 	} else if (prx.lb == LB_RANDOM) {
-		return prx.pick_random()
+		k = prx.pick_random(now)
+	} else if (prx.lb == LB_LEAST) {
+		k = prx.pick_least(now)
+	} else if (prx.lb == LB_P2C) {
+		k = prx.pick_p2c(now)
+	} else {
+		// LB_HASH
+		k = prx.pick_hash(ctx, now)
 	}
 
-	// LB_HASH
-	return prx.pick_hash(ctx)
+	health := prx.healths[k]
+	breaker := prx.breakers[k]
+	if !breaker.allow(now, true) {
+		return nil, nil, nil, newExf(CircuitOpenException, "service=%#v endpoint=%s", prx.service, prx.endpoints[k])
+	}
+
+	con, err := prx.connectionAt(k)
+	return con, health, breaker, err
+}
+
+func (prx *_Proxy) record(health *_Health, breaker *_Breaker, err error, latency time.Duration) {
+	if breaker != nil {
+		breaker.record(err)
+	}
+	if health != nil && health.record(err, latency) && health.policy.probe {
+		prx.startProbing()
+	}
+}
+
+func (prx *_Proxy) breakerInfos() []_BreakerInfo {
+	prx.mutex.Lock()
+	defer prx.mutex.Unlock()
+
+	var infos []_BreakerInfo
+	for k, b := range prx.breakers {
+		if b.policy.failures <= 0 {
+			continue
+		}
+		infos = append(infos, _BreakerInfo{Endpoint:prx.endpoints[k], State:b.State().String(), Trips:b.Trips()})
+	}
+	return infos
 }
 
 type _Result struct {
+	prx      *_Proxy
+	con      *_Connection	// nil if the quest is not sent or oneway
+	health   *_Health
+	breaker  *_Breaker
+	span     *_ActiveSpan
+	start    time.Time
+	endpoint string
 	txid     int64
+	high     bool		// the quest is of high priority
 	service  string
 	method   string
 	in       any
@@ -245,14 +555,29 @@ type _Result struct {
 	done     atomic.Bool
 	mtx      sync.Mutex
 	cond     sync.Cond
+	doneChan chan struct{}
+	callback func(Result)
+	stream   *_ClientStream	// nil if not streaming
 }
 
 func (r *_Result) Txid() int64     { return r.txid }
 func (r *_Result) Service() string { return r.service }
 func (r *_Result) Method() string  { return r.method }
 func (r *_Result) In() any         { return r.in }
+func (r *_Result) Endpoint() string { return r.endpoint }
 func (r *_Result) Out() any        { return r.out }
-func (r *_Result) Err() error      { return r.err }
+func (r *_Result) Err() error {
+	if st := r.stream; st != nil {
+		// st.err is set by Next()
+		r.cond.L.Lock()
+		err := st.err
+		r.cond.L.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return r.err
+}
 func (r *_Result) Done() bool      { return r.done.Load() }
 
 func (r *_Result) Wait() {
@@ -263,11 +588,83 @@ func (r *_Result) Wait() {
 	r.cond.L.Unlock()
 }
 
+func (r *_Result) DoneChan() <-chan struct{} {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	if r.doneChan == nil {
+		r.doneChan = make(chan struct{})
+		if r.done.Load() {
+			close(r.doneChan)
+		}
+	}
+	return r.doneChan
+}
+
 func (r *_Result) broadcast() {
+	if r.prx != nil {
+		health := r.health
+		if (r.stream != nil && r.err == nil) || isCanceled(r.err) {
+			// The duration of the stream is not the latency,
+			// and the canceled invoke is neither success nor failure
+			health = nil
+		}
+		r.prx.record(health, r.breaker, r.err, time.Since(r.start))
+	}
+	if r.span != nil {
+		r.span.Peer = r.endpoint
+		r.span.finish(r.err)
+	}
 	r.cond.L.Lock()
 	r.done.Store(true)
 	r.cond.Broadcast()
+	if r.doneChan != nil {
+		close(r.doneChan)
+	}
 	r.cond.L.Unlock()
+
+	if r.callback != nil {
+		go r.callback(r)
+	}
+}
+
+// WaitN waits until n of the results are done or the deadline expires.
+// Zero deadline means no deadline.
+// The done results are returned in the order of completion.
+func WaitN(n int, deadline time.Time, results ...Result) []Result {
+	if n > len(results) {
+		n = len(results)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	doneChan := make(chan Result, len(results))
+	for _, res := range results {
+		go func(res Result) {
+			select {
+			case <-res.DoneChan():
+				doneChan <- res
+			case <-stop:
+			}
+		}(res)
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	dones := make([]Result, 0, n)
+	for len(dones) < n {
+		select {
+		case res := <-doneChan:
+			dones = append(dones, res)
+		case <-timeout:
+			return dones
+		}
+	}
+	return dones
 }
 
 func assert_valid_in(in any) {
@@ -302,6 +699,18 @@ func (prx *_Proxy) InvokeAsync(method string, in, out any) Result {
 }
 
 func (prx *_Proxy) InvokeCtxAsync(ctx Context, method string, in, out any) Result {
+	return prx.invoke_async(ctx, method, in, out, nil, nil)
+}
+
+func (prx *_Proxy) InvokeAsyncCallback(method string, in, out any, callback func(Result)) Result {
+	return prx.invoke_async(nil, method, in, out, callback, nil)
+}
+
+func (prx *_Proxy) InvokeCtxAsyncCallback(ctx Context, method string, in, out any, callback func(Result)) Result {
+	return prx.invoke_async(ctx, method, in, out, callback, nil)
+}
+
+func (prx *_Proxy) invoke_async(ctx Context, method string, in, out any, callback func(Result), stream *_ClientStream) *_Result {
 	assert_valid_in(in)
 	assert_valid_out(out)
 	if ctx != nil {
@@ -310,24 +719,99 @@ func (prx *_Proxy) InvokeCtxAsync(ctx Context, method string, in, out any) Resul
 		ctx = prx.Context()
 	}
 
-	res := &_Result{txid: -1, service: prx.service, method: method, in: in, out: out}
+	ctx, span := prx.engine.startClientSpan(ctx, prx.service, method)
+	res := &_Result{prx: prx, span: span, start: time.Now(), txid: -1, service: prx.service, method: method, in: in, out: out, callback: callback, stream: stream}
 	res.cond.L = &res.mtx
 
-	con, err := prx.pickConnection(ctx)
+	con, health, breaker, err := prx.pickConnection(ctx)
+	res.health = health
+	res.breaker = breaker
 	if err != nil {
 		res.err = err
+		res.broadcast()
 	} else {
+		res.endpoint = con.Endpoint()
+		if stream != nil {
+			stream.con = con
+		}
 		if in == nil {
 			in = struct{}{}
 		}
 		q := newOutQuest(-1, prx.service, method, ctx, in)
-		con.invoke(prx, q, res)
+		// res.err may be set by the connection once the quest is pending
+		if con.invoke(prx, q, res) != nil {
+			res.broadcast()
+		}
+	}
+	return res
+}
+
+func (prx *_Proxy) InvokeBatch(calls []BatchCall) []Result {
+	results := make([]Result, len(calls))
+	batch := make([]*_Result, len(calls))
+	quests := make([]*_OutQuest, len(calls))
+	var con *_Connection
+	var health *_Health
+	var breaker *_Breaker
+	var err error
+	for i := range calls {
+		c := &calls[i]
+		assert_valid_in(c.In)
+		assert_valid_out(c.Out)
+		ctx := c.Ctx
+		if ctx != nil {
+			ctx.Extend(prx.Context())
+		} else {
+			ctx = prx.Context()
+		}
+
+		// All the quests are sent through the connection picked for the first one
+		if i == 0 {
+			con, health, breaker, err = prx.pickConnection(ctx)
+		}
+
+		ctx, span := prx.engine.startClientSpan(ctx, prx.service, c.Method)
+		res := &_Result{prx: prx, span: span, start: time.Now(), txid: -1, service: prx.service, method: c.Method, in: c.In, out: c.Out}
+		res.cond.L = &res.mtx
+		res.health = health
+		res.breaker = breaker
+		results[i] = res
+		batch[i] = res
+
+		in := c.In
+		if in == nil {
+			in = struct{}{}
+		}
+		quests[i] = newOutQuest(-1, prx.service, c.Method, ctx, in)
 	}
 
-	if res.err != nil {
-		res.broadcast()
+	// res.err may be set by the connection once the quest is pending,
+	// only the errors returned are failed here
+	errs := make([]error, len(calls))
+	if err != nil {
+		for i, res := range batch {
+			res.err = err
+			errs[i] = err
+		}
+	} else if len(calls) > 0 {
+		endpoint := con.Endpoint()
+		for _, res := range batch {
+			res.endpoint = endpoint
+		}
+		if len(calls) == 1 {
+			errs[0] = con.invoke(prx, quests[0], batch[0])
+		} else {
+			errs = con.invokeBatch(quests, batch)
+		}
 	}
-	return res
+
+	for i, e := range errs {
+		if e != nil {
+			quests[i].release()
+			batch[i].broadcast()
+		}
+	}
+	return results
 }
 
 func (prx *_Proxy) InvokeOneway(method string, in any) error {
@@ -345,13 +829,122 @@ func (prx *_Proxy) InvokeCtxOneway(ctx Context, method string, in any) error {
 	if in == nil {
 		in = struct{}{}
 	}
+	ctx, span := prx.engine.startClientSpan(ctx, prx.service, method)
 	q := newOutQuest(0, prx.service, method, ctx, in)
-	con, err := prx.pickConnection(ctx)
+	con, health, breaker, err := prx.pickConnection(ctx)
 	if err != nil {
+		prx.record(health, breaker, err, 0)
+		span.finish(err)
 		return err
 	}
 
-	con.invoke(prx, q, nil)
-	return nil
+	err = con.invoke(prx, q, nil)
+	if breaker != nil {
+		// No answer for oneway invoke, sent is success
+		breaker.record(err)
+	}
+	if span != nil {
+		span.Peer = con.Endpoint()
+		span.finish(err)
+	}
+	return err
+}
+
+
+func (prx *_Proxy) InvokeAll(ctx Context, method string, in any, outFactory func() any) []Result {
+	return prx.invoke_all(ctx, method, in, outFactory, true)
 }
 
+func (prx *_Proxy) InvokeAllOneway(ctx Context, method string, in any) []Result {
+	return prx.invoke_all(ctx, method, in, nil, false)
+}
+
+type _Target struct {
+	endpoint string
+	con *_Connection
+	health *_Health
+	breaker *_Breaker
+	err error
+}
+
+// The ejected endpoints are not skipped, but the open circuit breakers are respected.
+func (prx *_Proxy) allConnections() []_Target {
+	prx.mutex.Lock()
+	defer prx.mutex.Unlock()
+	if prx.fixed {
+		con := prx.cons[0]
+		t := _Target{endpoint: con.Endpoint()}
+		if con.IsLive() {
+			t.con = con
+		} else {
+			t.err = xerr.Errorf("Broken connection of fixed proxy")
+		}
+		return []_Target{t}
+	}
+
+	if len(prx.endpoints) == 0 {
+		return []_Target{{err: newExf(NoEndpointException, "service=%#v", prx.service)}}
+	}
+
+	now := time.Now()
+	targets := make([]_Target, len(prx.endpoints))
+	for k, ep := range prx.endpoints {
+		t := &targets[k]
+		t.endpoint = ep
+		if !prx.breakers[k].allow(now, true) {
+			t.err = newExf(CircuitOpenException, "service=%#v endpoint=%s", prx.service, ep)
+			continue
+		}
+		t.health = prx.healths[k]
+		t.breaker = prx.breakers[k]
+		t.con, t.err = prx.connectionAt(k)
+	}
+	return targets
+}
+
+func (prx *_Proxy) invoke_all(ctx Context, method string, in any, outFactory func() any, twoway bool) []Result {
+	assert_valid_in(in)
+	if ctx != nil {
+		ctx.Extend(prx.Context())
+	} else {
+		ctx = prx.Context()
+	}
+
+	args := in
+	if args == nil {
+		args = struct{}{}
+	}
+
+	targets := prx.allConnections()
+	results := make([]Result, 0, len(targets))
+	for _, t := range targets {
+		qctx, span := prx.engine.startClientSpan(ctx, prx.service, method)
+		res := &_Result{prx: prx, health: t.health, breaker: t.breaker, span: span, start: time.Now(), endpoint: t.endpoint,
+				txid: -1, service: prx.service, method: method, in: in}
+		res.cond.L = &res.mtx
+		results = append(results, res)
+
+		if t.err != nil {
+			res.err = t.err
+			res.broadcast()
+		} else if twoway {
+			if outFactory != nil {
+				res.out = outFactory()
+				assert_valid_out(res.out)
+			}
+			q := newOutQuest(-1, prx.service, method, qctx, args)
+			// res.err may be set by the connection once the quest is pending
+			if t.con.invoke(prx, q, res) != nil {
+				res.broadcast()
+			}
+		} else {
+			q := newOutQuest(0, prx.service, method, qctx, args)
+			res.err = t.con.invoke(prx, q, nil)
+			// No answer for oneway invoke, sent is success, no latency
+			res.txid = 0
+			res.health = nil
+			res.broadcast()
+		}
+	}
+	return results
+}
@@ -0,0 +1,256 @@
+package xic
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitN(t *testing.T) {
+	var rs []Result
+	for i := 0; i < 3; i++ {
+		res := &_Result{txid: int64(i)}
+		res.cond.L = &res.mtx
+		rs = append(rs, res)
+	}
+
+	called := make(chan Result, 1)
+	rs[2].(*_Result).callback = func(r Result) { called <- r }
+	ch := rs[2].DoneChan()
+	rs[2].(*_Result).broadcast()
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("DoneChan() not closed")
+	}
+	if r := <-called; r != rs[2] {
+		t.Errorf("wrong Result for the callback")
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		rs[0].(*_Result).broadcast()
+	}()
+	dones := WaitN(2, time.Time{}, rs...)
+	if len(dones) != 2 || dones[0] != rs[2] || dones[1] != rs[0] {
+		t.Fatalf("Bug in WaitN(), got %v", dones)
+	}
+
+	dones = WaitN(3, time.Now().Add(time.Millisecond * 10), rs...)
+	if len(dones) != 2 {
+		t.Errorf("Bug in WaitN(), got %v", dones)
+	}
+}
+
+func TestSharedConnection(t *testing.T) {
+	srv, cli, adapter, endpoint := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv, cli)
+	adapter.MustAddServant("Other", &_BenchServant{})
+
+	// Two services at the same endpoint
+	p1, _ := cli.StringToProxy("Bench" + endpoint)
+	p2, _ := cli.StringToProxy("Other" + endpoint)
+	for _, prx := range []Proxy{p1, p2} {
+		if err := prx.Invoke("echo", _BenchArgs{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prx1, prx2 := p1.(*_Proxy), p2.(*_Proxy)
+	con := prx2.cons[0]
+	if prx1.cons[0] != con {
+		t.Fatalf("Connection not shared by the proxies")
+	}
+
+	// The connection is still used by the other proxy
+	prx1.setEndpoints(nil)
+	if !con.IsLive() {
+		t.Fatalf("Connection closed while used by another proxy")
+	}
+	if err := p2.Invoke("echo", _BenchArgs{}, nil); err != nil || prx2.cons[0] != con {
+		t.Fatalf("Connection not kept, err=%v", err)
+	}
+
+	prx2.setEndpoints(nil)
+	con.mutex.Lock()
+	state := con.state
+	con.mutex.Unlock()
+	if state < con_CLOSING {
+		t.Errorf("Connection not closed after all the proxies dropped it")
+	}
+}
+
+// Resolve slowly
+type _SlowResolver struct {
+	watched atomic.Int32
+}
+
+func (r *_SlowResolver) Resolve(service string) ([]string, error) {
+	time.Sleep(time.Millisecond * 10)
+	return []string{"@tcp+127.0.0.1+1"}, nil
+}
+
+func (r *_SlowResolver) Watch(service string, fn func(endpoints []string)) {
+	r.watched.Add(1)
+}
+
+func (r *_SlowResolver) Refresh(service string) {}
+func (r *_SlowResolver) Close() {}
+
+func TestStringToProxyRace(t *testing.T) {
+	engine := newEngineSetting(NewSetting())
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+	resolver := &_SlowResolver{}
+	engine.SetResolver(resolver)
+
+	const ep = "@tcp+127.0.0.1+1"
+	prxs := make([]Proxy, 20)
+	var wg sync.WaitGroup
+	for i := range prxs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			prxs[i], _ = engine.StringToProxy("Demo")
+		}(i)
+	}
+	wg.Wait()
+	for _, prx := range prxs {
+		if prx == nil || prx != prxs[0] {
+			t.Fatalf("Different proxies created for the same string")
+		}
+	}
+	engine.mutex.Lock()
+	refs := engine.outConRefs["@tcp+127.0.0.1+1"]
+	engine.mutex.Unlock()
+	if refs != 1 || resolver.watched.Load() != 1 {
+		t.Fatalf("The endpoint referenced %d times and watched %d times, should be 1", refs, resolver.watched.Load())
+	}
+
+	// The proxy discarded doesn't hold the endpoints
+	prx := newProxy(engine, "Other" + ep, nil)
+	prx.release()
+	prx.setEndpoints([]string{"@tcp+127.0.0.1+2"})
+	engine.mutex.Lock()
+	refs, refs2 := engine.outConRefs["@tcp+127.0.0.1+1"], engine.outConRefs["@tcp+127.0.0.1+2"]
+	engine.mutex.Unlock()
+	if refs != 1 || refs2 != 0 {
+		t.Errorf("Endpoints referenced by the proxy released, refs=%d %d", refs, refs2)
+	}
+}
+
+func TestPickLeast(t *testing.T) {
+	engine := newEngineSetting(NewSetting())
+	defer engine.WaitForShutdown()
+	defer engine.Shutdown()
+
+	prx := newProxy(engine, "Demo -lb:least @tcp+10.0.0.1+1234 @tcp+10.0.0.2+1234 @tcp+10.0.0.3+1234", nil)
+	prx.healths[0].record(nil, time.Millisecond * 10)
+	prx.healths[1].record(nil, time.Millisecond * 5)
+
+	// The endpoint without latency samples is preferred
+	now := time.Now()
+	if k := prx.pick_least(now); k != 2 {
+		t.Fatalf("pick_least() got %d, should be 2", k)
+	}
+
+	// but not after it has many pending invokes
+	con := _newConnection(engine, false)
+	for i := 0; i < 20; i++ {
+		con.pending[int64(i+1)] = &_Result{}
+	}
+	prx.cons[2] = con
+	if k := prx.pick_least(now); k != 1 {
+		t.Fatalf("pick_least() got %d, should be 1", k)
+	}
+
+	prx = newProxy(engine, "Demo -lb:p2c @tcp+10.0.0.1+1234 @tcp+10.0.0.2+1234", nil)
+	prx.healths[1].record(nil, time.Millisecond * 5)
+	prx.cons[0] = con
+	n := 0
+	for i := 0; i < 100; i++ {
+		if prx.pick_p2c(now) == 0 {
+			n++
+		}
+	}
+	// 0 is picked only if both of the two choices are 0
+	if n > 30 {
+		t.Errorf("pick_p2c() picked the endpoint of more cost %d times", n)
+	}
+}
+
+type _NameServant struct {
+	DefaultServant
+	name string
+	notified atomic.Int32
+}
+
+type _NameArgs struct {
+	Name string	`vbs:"name"`
+}
+
+func (s *_NameServant) Xic_name(cur Current, in struct{}, out *_NameArgs) error {
+	out.Name = s.name
+	return nil
+}
+
+func (s *_NameServant) Xic_notify(cur Current, in struct{}) error {
+	s.notified.Add(1)
+	return nil
+}
+
+func TestInvokeAll(t *testing.T) {
+	srv1, cli, adapter1, ep1 := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv1, cli)
+	srv2, cli2, adapter2, ep2 := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv2, cli2)
+	s1 := &_NameServant{name:"s1"}
+	s2 := &_NameServant{name:"s2"}
+	adapter1.MustAddServant("Name", s1)
+	adapter2.MustAddServant("Name", s2)
+
+	// Nothing listens on the third endpoint
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep3 := fmt.Sprintf("@tcp+127.0.0.1+%d", l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	prx, _ := cli.StringToProxy("Name" + ep1 + " " + ep2 + " " + ep3)
+	results := prx.InvokeAll(nil, "name", nil, func() any { return &_NameArgs{} })
+	if len(results) != 3 {
+		t.Fatalf("InvokeAll() got %d results", len(results))
+	}
+	var names []string
+	for _, r := range results {
+		r.Wait()
+		if r.Endpoint() == ep3 {
+			if r.Err() == nil {
+				t.Errorf("Invoke to the down endpoint should fail")
+			}
+		} else if r.Err() != nil {
+			t.Errorf("Invoke to %s failed: %v", r.Endpoint(), r.Err())
+		} else {
+			names = append(names, r.Out().(*_NameArgs).Name)
+		}
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[s1 s2]" {
+		t.Errorf("InvokeAll() got answers from %v", names)
+	}
+
+	results = prx.InvokeAllOneway(nil, "notify", nil)
+	if len(results) != 3 {
+		t.Fatalf("InvokeAllOneway() got %d results", len(results))
+	}
+	for i := 0; i < 100 && (s1.notified.Load() == 0 || s2.notified.Load() == 0); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if s1.notified.Load() != 1 || s2.notified.Load() != 1 {
+		t.Errorf("InvokeAllOneway() notified %d and %d times", s1.notified.Load(), s2.notified.Load())
+	}
+}
@@ -0,0 +1,158 @@
+package xic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"halftwo/mangos/dlog"
+	"halftwo/mangos/vbs"
+	"halftwo/mangos/xerr"
+)
+
+/*
+   If xic.record.file is set, the quests served and their answers are
+   appended to the file, sampled with the probability xic.record.sample.
+   The quests of the streaming methods are not recorded.
+
+   Each record in the file is a 4-byte big-endian length followed by
+   the VBS encoded Record. See RecordReader and cmd/xicreplay.
+*/
+type Record struct {
+	Time     int64   `vbs:"time"`		// unix time in microseconds when the quest received
+	Duration int64   `vbs:"duration"`	// microseconds to serve the quest
+	Service  string  `vbs:"service"`
+	Method   string  `vbs:"method"`
+	Ctx      Context `vbs:"ctx"`
+	Oneway   bool    `vbs:"oneway,omitempty"`
+	Args     []byte  `vbs:"args"`		// VBS encoded arguments of the quest
+	Status   int     `vbs:"status"`		// 0 for normal answer, -1 for exception
+	Answer   []byte  `vbs:"answer"`		// VBS encoded arguments of the answer, empty for oneway
+}
+
+// The maximum size of a record
+const MaxRecordSize = 64*1024*1024
+
+type _Recorder struct {
+	sample float64
+	mutex sync.Mutex
+	file *os.File
+	w *bufio.Writer
+}
+
+func newRecorder(filename string, sample float64) (*_Recorder, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, xerr.Trace(err)
+	}
+	return &_Recorder{sample:sample, file:file, w:bufio.NewWriter(file)}, nil
+}
+
+func (r *_Recorder) sampled() bool {
+	return r.sample >= 1.0 || rand.Float64() < r.sample
+}
+
+// The record is flushed to the file immediately
+func (r *_Recorder) write(rec *Record) error {
+	buf, err := vbs.Marshal(rec)
+	if err != nil {
+		return xerr.Trace(err)
+	}
+	var head [4]byte
+	binary.BigEndian.PutUint32(head[:], uint32(len(buf)))
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	r.w.Write(head[:])
+	r.w.Write(buf)
+	return r.w.Flush()
+}
+
+func (r *_Recorder) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file != nil {
+		r.w.Flush()
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// Return nil if the quest is not recorded.
+// Called before the arguments decoded, which may release the buffer of the quest.
+func (con *_Connection) startRecord(quest *_InQuest, start time.Time) *Record {
+	r := con.engine.recorder
+	if r == nil || !r.sampled() {
+		return nil
+	}
+
+	rec := &Record{Time:start.UnixMicro(), Service:quest.service, Method:quest.method, Oneway:quest.txid == 0}
+	rec.Ctx = make(Context, len(quest.ctx))
+	for k, v := range quest.ctx {
+		rec.Ctx[k] = v
+	}
+	rec.Args = append([]byte(nil), quest.buf[quest.argsOff:]...)
+	return rec
+}
+
+// Called before the answer sent, which may be encrypted in place
+func (con *_Connection) finishRecord(rec *Record, start time.Time, answer *_OutAnswer, stream bool) {
+	if rec == nil || stream {
+		return
+	}
+
+	rec.Duration = time.Since(start).Microseconds()
+	if answer != nil {
+		rec.Status = answer.status
+		rec.Answer = append([]byte(nil), answer.buf[answer.argsOff:]...)
+	}
+	if err := con.engine.recorder.write(rec); err != nil {
+		dlog.Log("XIC.WARN", "Failed to write record of %s::%s --- %s", rec.Service, rec.Method, err.Error())
+	}
+}
+
+// RecordReader reads the records written by the engine, see Record.
+type RecordReader struct {
+	r *bufio.Reader
+	buf []byte
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r:bufio.NewReader(r)}
+}
+
+// Return io.EOF after the last record
+func (rr *RecordReader) Next() (*Record, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(rr.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, xerr.Errorf("Truncated record")
+		}
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(head[:]))
+	if size > MaxRecordSize {
+		return nil, xerr.Errorf("Record size too large, size=%d", size)
+	}
+	if cap(rr.buf) < size {
+		rr.buf = make([]byte, size)
+	}
+	buf := rr.buf[:size]
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, xerr.Errorf("Truncated record")
+	}
+
+	rec := &Record{}
+	if _, err := vbs.Unmarshal(buf, rec); err != nil {
+		return nil, xerr.Trace(err)
+	}
+	return rec, nil
+}
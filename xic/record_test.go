@@ -0,0 +1,54 @@
+package xic
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"halftwo/mangos/vbs"
+)
+
+func TestRecordFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "record")
+	r, err := newRecorder(filename, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, _ := vbs.Marshal(map[string]any{"blob":[]byte("hello"), "num":12345})
+	answer, _ := vbs.Marshal(map[string]any{"str":"world"})
+	records := []Record{
+		{Time:1, Duration:10, Service:"Demo", Method:"echo", Ctx:Context{"a":"b"}, Args:args, Answer:answer},
+		{Time:2, Duration:20, Service:"Demo", Method:"fail", Ctx:Context{}, Args:args, Status:answer_EXCEPTION, Answer:answer},
+		{Time:3, Duration:30, Service:"Demo", Method:"notify", Ctx:Context{}, Oneway:true, Args:args},
+	}
+	for k := range records {
+		if err := r.write(&records[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rr := NewRecordReader(file)
+	for k := range records {
+		rec, err := rr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rec.Args, records[k].Args) || !reflect.DeepEqual(rec.Answer, records[k].Answer) ||
+			rec.Method != records[k].Method || rec.Status != records[k].Status || rec.Oneway != records[k].Oneway ||
+			rec.Duration != records[k].Duration || rec.Ctx.GetString("a", "") != records[k].Ctx.GetString("a", "") {
+			t.Errorf("Wrong record %d: %v", k, rec)
+		}
+	}
+	if _, err := rr.Next(); err != io.EOF {
+		t.Errorf("Should be io.EOF after the last record, err=%v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package xic
+
+import (
+	"os"
+	"bufio"
+	"strings"
+	"sync"
+	"time"
+
+	"halftwo/mangos/xstr"
+	"halftwo/mangos/xerr"
+	"halftwo/mangos/dlog"
+)
+
+/*
+   The registry file maps service names to endpoints, one service per line:
+
+	# service = endpoint endpoint ...
+	Demo = @tcp+192.168.1.1+5555 timeout=5000 @tcp+192.168.1.2+5555
+
+   The file is checked every interval, and the watchers of the services
+   whose endpoints changed are called.
+*/
+type _FileResolver struct {
+	filename string
+	mtime time.Time
+	services map[string][]string
+	watchers map[string][]func([]string)
+	mutex sync.Mutex
+	refreshMutex sync.Mutex	// serializes the refreshes
+	doneChan chan struct{}
+	once sync.Once
+}
+
+var _ Resolver = (*_FileResolver)(nil)
+
+const DEFAULT_REGISTRY_INTERVAL = time.Second * 5
+
+func NewFileResolver(filename string, interval time.Duration) (Resolver, error) {
+	fr := &_FileResolver{filename:filename, doneChan:make(chan struct{})}
+	fr.watchers = make(map[string][]func([]string))
+	if _, err := fr.load(); err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 {
+		interval = DEFAULT_REGISTRY_INTERVAL
+	}
+	go fr.watch_routine(interval)
+	return fr, nil
+}
+
+func parseRegistryEndpoints(value string) ([]string, error) {
+	var endpoints []string
+	sp := xstr.NewSplitter(value, "@")
+	sp.Next()	// the part before the first '@' should be empty
+	for sp.HasMore() {
+		ei, err := parseEndpoint(sp.Next())
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, ei.String())
+	}
+	return endpoints, nil
+}
+
+func readRegistryFile(filename string) (map[string][]string, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, xerr.Trace(err)
+	}
+	defer fp.Close()
+
+	services := make(map[string][]string)
+	scanner := bufio.NewScanner(fp)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		service, value := xstr.Split2(line, "=")
+		service = strings.TrimSpace(service)
+		value = strings.TrimSpace(value)
+		if service == "" || !strings.HasPrefix(value, "@") {
+			return nil, xerr.Errorf("registry: invalid service=endpoints in %s:%d", filename, lineno)
+		}
+
+		endpoints, err := parseRegistryEndpoints(value)
+		if err != nil {
+			return nil, xerr.Tracef(err, "registry: invalid endpoint in %s:%d", filename, lineno)
+		}
+		services[service] = append(services[service], endpoints...)
+	}
+	return services, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// return the names of the changed services
+func (fr *_FileResolver) load() ([]string, error) {
+	fi, err := os.Stat(fr.filename)
+	if err != nil {
+		return nil, xerr.Tracef(err, "os.Stat() failed on file \"%s\"", fr.filename)
+	}
+
+	fr.mutex.Lock()
+	mtime := fr.mtime
+	fr.mutex.Unlock()
+	if fi.ModTime() == mtime {
+		return nil, nil
+	}
+
+	services, err := readRegistryFile(fr.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	fr.mutex.Lock()
+	for name, eps := range fr.services {
+		if !equalStrings(eps, services[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range services {
+		if _, ok := fr.services[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	fr.services = services
+	fr.mtime = fi.ModTime()
+	fr.mutex.Unlock()
+	return changed, nil
+}
+
+func (fr *_FileResolver) watch_routine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fr.doneChan:
+			return
+		case <-ticker.C:
+			fr.Refresh("")
+		}
+	}
+}
+
+func (fr *_FileResolver) notify(service string) {
+	fr.mutex.Lock()
+	endpoints := fr.services[service]
+	watchers := fr.watchers[service]
+	fr.mutex.Unlock()
+
+	for _, fn := range watchers {
+		fn(endpoints)
+	}
+}
+
+func (fr *_FileResolver) Resolve(service string) ([]string, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	endpoints, ok := fr.services[service]
+	if !ok {
+		return nil, newExf(ServiceNotFoundException, "service %#v not found in registry", service)
+	}
+	return endpoints, nil
+}
+
+func (fr *_FileResolver) Watch(service string, fn func(endpoints []string)) {
+	fr.mutex.Lock()
+	fr.watchers[service] = append(fr.watchers[service], fn)
+	fr.mutex.Unlock()
+}
+
+func (fr *_FileResolver) Refresh(service string) {
+	fr.refreshMutex.Lock()
+	defer fr.refreshMutex.Unlock()
+	changed, err := fr.load()
+	if err != nil {
+		dlog.Log("XIC.WARN", "Failed to reload registry file %#v: %s", fr.filename, err.Error())
+		return
+	}
+	if len(changed) > 0 {
+		dlog.Log("XIC.INFO", "Registry file %#v reloaded, changed=%v", fr.filename, changed)
+	}
+	for _, service := range changed {
+		fr.notify(service)
+	}
+}
+
+func (fr *_FileResolver) Close() {
+	fr.once.Do(func() {
+		close(fr.doneChan)
+	})
+}
+
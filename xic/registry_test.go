@@ -0,0 +1,71 @@
+package xic
+
+import (
+	"testing"
+	"os"
+	"io/ioutil"
+	"time"
+	"sync"
+)
+
+func TestFileResolver(t *testing.T) {
+	fp, err := ioutil.TempFile("", "registry.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := fp.Name()
+	defer os.Remove(filename)
+	fp.WriteString(`
+# service = endpoints
+Demo = @tcp+192.168.1.1+5555 timeout=5000 @+192.168.1.2+5555
+Other = @tcp+::1+3030
+`)
+	fp.Close()
+
+	fr, err := NewFileResolver(filename, time.Millisecond * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+
+	eps, err := fr.Resolve("Demo")
+	if err != nil || len(eps) != 2 || eps[0] != "@tcp+192.168.1.1+5555 timeout=5000" || eps[1] != "@tcp+192.168.1.2+5555" {
+		t.Fatalf("Resolve() failed, got %v %v", eps, err)
+	}
+	if _, err = fr.Resolve("Nothing"); err == nil {
+		t.Errorf("Resolve() should fail on unknown service")
+	}
+
+	ch := make(chan []string, 10)
+	fr.Watch("Demo", func(endpoints []string) {
+		ch <- endpoints
+	})
+
+	ioutil.WriteFile(filename, []byte("Demo = @tcp+192.168.1.3+5555\nOther = @tcp+::1+3030\n"), 0644)
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Second))
+	select {
+	case eps = <-ch:
+		if len(eps) != 1 || eps[0] != "@tcp+192.168.1.3+5555" {
+			t.Errorf("Watch() got %v", eps)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Watch() not called")
+	}
+
+	// Concurrent refreshes should notify the change only once
+	ioutil.WriteFile(filename, []byte("Demo = @tcp+192.168.1.4+5555\n"), 0644)
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Second * 2))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fr.Refresh("Demo")
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 50)
+	if n := len(ch); n != 1 {
+		t.Errorf("Watch() called %d times, should be once", n)
+	}
+}
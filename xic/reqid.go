@@ -0,0 +1,199 @@
+package xic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"halftwo/mangos/dlog"
+)
+
+/*
+   A client retrying a non-idempotent method can set a unique XIC_REQID
+   (a string or an integer) in the Context of the quest. The server keeps
+   the answers of the recent request ids in a cache of at most
+   xic.reqid.size entries, for xic.reqid.ttl seconds after the first quest
+   received. A duplicate quest (the same XIC_REQID, service and method)
+   from the same client within the window is answered with the cached
+   answer instead of served again. If the first quest is still being
+   served, the duplicate waits for its answer. The client is identified
+   by the identity authenticated, so the retries through a new connection
+   are deduplicated too. Without authentication, only the quests of the
+   same connection are deduplicated.
+
+   If the first quest is canceled, or answered without being served by
+   the servant (e.g. with an injected fault), the answer is not cached,
+   and the duplicates waiting for it are served instead.
+
+   The quests of the streaming methods (with XIC_STREAM in the Context)
+   and of the keeper service are not deduplicated. XIC_REQID is removed
+   from the Context before the quest dispatched, so it won't be propagated
+   into the nested calls made with Current.Ctx().
+*/
+type _ReqCache struct {
+	size int
+	ttl time.Duration
+	mutex sync.Mutex
+	entries map[string]*_ReqEntry
+	fifo []*_ReqEntry	// in the order of insertion, which is also the order of expiration
+}
+
+type _ReqEntry struct {
+	key string
+	expire time.Time
+	done chan struct{}	// closed after the answer set
+	aborted bool		// no answer cached, see abort()
+	status int
+	args []byte		// VBS encoded arguments of the answer, nil for oneway quest
+}
+
+const (
+	_DEFAULT_REQID_SIZE = 10000
+	_DEFAULT_REQID_TTL = time.Second * 60
+)
+
+// Return nil if xic.reqid.size <= 0
+func newReqCache(setting Setting) *_ReqCache {
+	size := int(setting.IntDefault("xic.reqid.size", _DEFAULT_REQID_SIZE))
+	if size <= 0 {
+		return nil
+	}
+	ttl := time.Second * time.Duration(setting.IntDefault("xic.reqid.ttl", int64(_DEFAULT_REQID_TTL / time.Second)))
+	return &_ReqCache{size:size, ttl:ttl, entries:make(map[string]*_ReqEntry)}
+}
+
+// The request ids of different clients don't collide, see reqKey()
+func (con *_Connection) reqScope() string {
+	if con.peerIdentity != "" {
+		return "@" + con.peerIdentity
+	}
+	return "#" + con.id
+}
+
+// Return "" if the quest is not deduplicated
+func reqKey(quest *_InQuest, scope string) string {
+	if quest.service == "\x00" || quest.ctx.Has("XIC_STREAM") {
+		return ""
+	}
+	var id string
+	switch v := quest.ctx["XIC_REQID"].(type) {
+	case string:
+		id = v
+	case int64:
+		id = fmt.Sprint(v)
+	}
+	if id == "" {
+		return ""
+	}
+	return scope + "\x00" + id + "\x00" + quest.service + "::" + quest.method
+}
+
+/*
+   Return nil if the quest is not deduplicated. Otherwise return the entry
+   of the request id, and true if the quest is the first one, which should
+   call finish() or abort() after served. If false, the quest is a duplicate, and
+   the answer is set in the entry after the entry is done.
+*/
+func (c *_ReqCache) start(quest *_InQuest, scope string) (*_ReqEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := reqKey(quest, scope)
+	if key == "" {
+		return nil, false
+	}
+
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c._evict(now)
+	if e, ok := c.entries[key]; ok {
+		return e, false
+	}
+
+	e := &_ReqEntry{key:key, expire:now.Add(c.ttl), done:make(chan struct{})}
+	c.entries[key] = e
+	c.fifo = append(c.fifo, e)
+	return e, true
+}
+
+func (c *_ReqCache) _evict(now time.Time) {
+	n := 0
+	for n < len(c.fifo) && (len(c.fifo) - n >= c.size || now.After(c.fifo[n].expire)) {
+		e := c.fifo[n]
+		if c.entries[e.key] == e {
+			delete(c.entries, e.key)
+		}
+		c.fifo[n] = nil
+		n++
+	}
+	c.fifo = c.fifo[n:]
+}
+
+// answer is nil for oneway quest.
+// Called before the answer sent, which may be encrypted in place.
+func (c *_ReqCache) finish(e *_ReqEntry, answer *_OutAnswer) {
+	if e == nil {
+		return
+	}
+	if answer != nil {
+		e.status = answer.status
+		e.args = append([]byte(nil), answer.buf[answer.argsOff:]...)
+	}
+	close(e.done)
+}
+
+// The answer of the first quest is not cached. The entry is removed, and
+// the duplicates waiting for it are served instead.
+func (c *_ReqCache) abort(e *_ReqEntry) {
+	if e == nil {
+		return
+	}
+	c.mutex.Lock()
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+	c.mutex.Unlock()
+	e.aborted = true
+	close(e.done)
+}
+
+// Answer the duplicate quest with the answer of the first one.
+// Return false if the first one aborted, the duplicate should be served.
+func (con *_Connection) answerDuplicate(quest *_InQuest, e *_ReqEntry) bool {
+	select {
+	case <-e.done:
+		if e.aborted && quest.cctx.Err() == nil {
+			return false
+		}
+	case <-quest.cctx.Done():
+	}
+	canceled := con.endQuestContext(quest)
+	select {
+	case <-e.done:
+	default:
+		// The connection closed
+		canceled = true
+	}
+
+	if quest.txid == 0 {
+		// No answer, see send_loop()
+		con.numQ.Add(-1)
+		return true
+	} else if canceled || e.aborted {
+		con.dropAnswer(quest, nil)
+		return true
+	}
+
+	var answer *_OutAnswer
+	if e.args != nil {
+		answer = newOutAnswerBytes(e.status, quest.txid, e.args)
+	} else {
+		// The first quest was oneway
+		answer = newOutAnswerNormal(quest.txid, struct{}{})
+	}
+	dlog.Log("XIC.INFO", "%s::%s --- Duplicate quest answered from cache, txid=%d con=%v", quest.service, quest.method, quest.txid, con)
+	answer.high = quest.high
+	con.answerQuest(quest, answer)
+	return true
+}
@@ -0,0 +1,182 @@
+package xic
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReqCache(t *testing.T) {
+	setting := NewSetting()
+	setting.Set("xic.reqid.size", "2")
+	c := newReqCache(setting)
+	if c == nil || c.size != 2 || c.ttl != _DEFAULT_REQID_TTL {
+		t.Fatalf("Bug in newReqCache()")
+	}
+
+	quest := func(reqid any) *_InQuest {
+		return &_InQuest{txid:1, service:"Demo", method:"pay", ctx:Context{"XIC_REQID":reqid}}
+	}
+	if reqKey(quest(""), "#1") != "" || reqKey(&_InQuest{service:"Demo", method:"pay", ctx:Context{}}, "#1") != "" {
+		t.Errorf("Quest without XIC_REQID should not be deduplicated")
+	}
+	if reqKey(quest(int64(12)), "@alice") != "@alice\x0012\x00Demo::pay" {
+		t.Errorf("Bug in reqKey()")
+	}
+
+	e1, first := c.start(quest("a"), "#1")
+	if e1 == nil || !first {
+		t.Fatalf("The first quest should be served")
+	}
+	dup, first := c.start(quest("a"), "#1")
+	if dup != e1 || first {
+		t.Fatalf("The duplicate quest should wait for the first one")
+	}
+	if e, first := c.start(quest("a"), "#2"); e == e1 || !first {
+		t.Fatalf("The quests of different clients should not be deduplicated")
+	}
+	select {
+	case <-dup.done:
+		t.Fatalf("The entry should not be done yet")
+	default:
+	}
+
+	answer := newOutAnswerNormal(1, map[string]any{"ok":true})
+	c.finish(e1, answer)
+	<-dup.done
+	replay := newOutAnswerBytes(dup.status, 7, dup.args)
+	expect := newOutAnswerNormal(7, map[string]any{"ok":true})
+	if !bytes.Equal(replay.Bytes(), expect.Bytes()) {
+		t.Errorf("Wrong cached answer")
+	}
+
+	// The duplicate is served after the first one aborted
+	e2, _ := c.start(quest("x"), "#1")
+	dup, _ = c.start(quest("x"), "#1")
+	c.abort(e2)
+	<-dup.done
+	if e, first := c.start(quest("x"), "#1"); !dup.aborted || e == e2 || !first {
+		t.Fatalf("The aborted entry should be removed")
+	}
+
+	// Evicted by size
+	c.start(quest("b"), "#1")
+	c.start(quest("c"), "#1")
+	if _, first = c.start(quest("a"), "#1"); !first || len(c.entries) != 2 {
+		t.Errorf("The oldest entry should be evicted")
+	}
+
+	// Evicted by ttl
+	c.ttl = time.Millisecond
+	c.entries = make(map[string]*_ReqEntry)
+	c.fifo = nil
+	c.start(quest("d"), "#1")
+	time.Sleep(time.Millisecond * 2)
+	if _, first = c.start(quest("d"), "#1"); !first {
+		t.Errorf("The expired entry should be evicted")
+	}
+
+	setting.Set("xic.reqid.size", "0")
+	if c = newReqCache(setting); c != nil {
+		t.Errorf("Cache should be disabled")
+	}
+	if e, _ := c.start(quest("a"), "#1"); e != nil {
+		t.Errorf("Disabled cache should not deduplicate")
+	}
+}
+
+type _ReqServant struct {
+	DefaultServant
+	served atomic.Int32
+	propagated atomic.Bool	// XIC_REQID found in Current.Ctx()
+	waited atomic.Int32
+	started chan struct{}
+}
+
+func (s *_ReqServant) Xic_pay(cur Current, in struct{}, out *_BenchArgs) error {
+	out.Seq = int(s.served.Add(1))
+	if cur.Ctx().Has("XIC_REQID") {
+		s.propagated.Store(true)
+	}
+	return nil
+}
+
+// The first one waits until canceled
+func (s *_ReqServant) Xic_wait(cur Current, in struct{}, out *_BenchArgs) error {
+	out.Seq = int(s.waited.Add(1))
+	if out.Seq == 1 {
+		close(s.started)
+		<-cur.Context().Done()
+	}
+	return nil
+}
+
+func TestReqIdScope(t *testing.T) {
+	for _, auth := range []bool{true, false} {
+		srv, cli, adapter, endpoint := startTestEngines(t, auth, nil, nil)
+		servant := &_ReqServant{}
+		adapter.MustAddServant("Req", servant)
+
+		// A new client engine makes a new connection
+		cli2 := newEngineSetting(NewSetting())
+		sec, _ := NewSecretBox(secret)
+		cli2.SetSecretBox(sec)
+
+		ctx := Context{"XIC_REQID":"pay-1"}
+		var out1, out2, out3 _BenchArgs
+		prx, _ := cli.StringToProxy("Req" + endpoint)
+		prx2, _ := cli2.StringToProxy("Req" + endpoint)
+		err1 := prx.InvokeCtx(ctx, "pay", struct{}{}, &out1)
+		err2 := prx.InvokeCtx(ctx, "pay", struct{}{}, &out2)
+		err3 := prx2.InvokeCtx(ctx, "pay", struct{}{}, &out3)
+		cli2.Shutdown()
+		cli2.WaitForShutdown()
+		stopTestEngines(srv, cli)
+
+		if err1 != nil || err2 != nil || err3 != nil {
+			t.Fatalf("Invoke failed: %v %v %v", err1, err2, err3)
+		}
+		if out1.Seq != 1 || out2.Seq != 1 {
+			t.Errorf("Duplicate quest served again, auth=%v", auth)
+		}
+		// The same identity through a new connection, or a different client
+		if (auth && out3.Seq != 1) || (!auth && out3.Seq != 2) {
+			t.Errorf("Wrong scope of XIC_REQID, auth=%v seq=%d", auth, out3.Seq)
+		}
+		if servant.propagated.Load() {
+			t.Errorf("XIC_REQID should be removed from Current.Ctx()")
+		}
+	}
+}
+
+func TestReqIdAbort(t *testing.T) {
+	srv, cli, adapter, endpoint := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv, cli)
+	servant := &_ReqServant{started:make(chan struct{})}
+	adapter.MustAddServant("Req", servant)
+	prx, _ := cli.StringToProxy("Req" + endpoint)
+
+	// The answer of the injected fault is not cached
+	srv.setting.Set("xic.fault.Req.exception", "1")
+	srv.faultEnable.Store(true)
+	ctx := Context{"XIC_REQID":"pay-1"}
+	var out _BenchArgs
+	if err := prx.InvokeCtx(ctx, "pay", struct{}{}, &out); err == nil {
+		t.Fatalf("Fault not injected")
+	}
+	srv.faultEnable.Store(false)
+	if err := prx.InvokeCtx(ctx, "pay", struct{}{}, &out); err != nil || out.Seq != 1 {
+		t.Errorf("The retry after injected fault not served, seq=%d err=%v", out.Seq, err)
+	}
+
+	// The answer of the canceled quest is not cached
+	ctx = Context{"XIC_REQID":"wait-1"}
+	res := prx.InvokeCtxAsync(ctx, "wait", struct{}{}, &out)
+	<-servant.started
+	res.Cancel()
+	time.Sleep(time.Millisecond * 50)
+	if err := prx.InvokeCtx(ctx, "wait", struct{}{}, &out); err != nil || out.Seq != 2 {
+		t.Errorf("The retry after canceled not served, seq=%d err=%v", out.Seq, err)
+	}
+}
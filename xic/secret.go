@@ -231,3 +231,15 @@ func (sb *SecretBox) find(service, proto, host string, port uint16) (identity, p
 }
 
 
+
+// FindIdentity returns the password of the first secret with the identity.
+// It is used by the server in the PSK authentication.
+func (sb *SecretBox) FindIdentity(identity string) (password string) {
+	for _, s := range sb.secrets {
+		if s.identity == identity {
+			return s.password
+		}
+	}
+	return ""
+}
+
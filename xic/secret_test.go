@@ -66,3 +66,17 @@ func TestSecretBox(t *testing.T) {
 	}
 }
 
+
+func TestSecretBoxFindIdentity(t *testing.T) {
+	sb, err := NewSecretBox(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pass := sb.FindIdentity("complex"); pass != "complicated" {
+		t.Errorf("Bug in (*Secret).FindIdentity(), got %#v", pass)
+	}
+	if pass := sb.FindIdentity("nobody"); pass != "" {
+		t.Errorf("Bug in (*Secret).FindIdentity(), got %#v", pass)
+	}
+}
@@ -95,7 +95,9 @@ func getMethodTable(servant Servant) (map[string]*MethodInfo, error) {
 			mi.Oneway = true
 		} else {
 			mi.OutType = m.Type.In(3)
-			if !IsValidOutType(mi.OutType) {
+			if mi.OutType == typeOfStream {
+				mi.Stream = true
+			} else if !IsValidOutType(mi.OutType) {
 				return nil, xerr.Errorf("Argument out of xic method must be a (pointer to) map[string]any or a pointer to struct")
 			}
 		}
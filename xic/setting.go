@@ -7,6 +7,8 @@ import (
 	"bufio"
 	"strings"
 	"strconv"
+	"sort"
+	"time"
 
 	"halftwo/mangos/xerr"
 )
@@ -14,8 +16,17 @@ import (
 type _Setting struct {
 	filename string
 	m sync.Map
+
+	mutex sync.Mutex
+	mtime time.Time		// of the file loaded, see Reload()
+	size int64
+	fileItems map[string]string	// items loaded from the file
+	explicit map[string]bool	// items set by Set(), Remove() or Insert(), see Reload()
+	watchers []SettingWatcher
 }
 
+var _ ReloadableSetting = (*_Setting)(nil)
+
 func NewSetting() Setting {
 	return &_Setting{}
 }
@@ -29,14 +40,20 @@ func NewSettingFile(filename string) (Setting, error) {
 	return st, nil
 }
 
-func (st *_Setting) LoadFile(filename string) error {
-	filename = filepath.Clean(filename)
+// The file info is got before read, so the changes after it won't be missed
+func readSettingFile(filename string) (map[string]string, os.FileInfo, error) {
 	fp, err := os.Open(filename)
 	if err != nil {
-		return xerr.Trace(err)
+		return nil, nil, xerr.Trace(err)
 	}
 	defer fp.Close()
 
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, nil, xerr.Trace(err)
+	}
+
+	items := make(map[string]string)
 	scanner := bufio.NewScanner(fp)
 	lineno := 0
 	for scanner.Scan() {
@@ -49,32 +66,130 @@ func (st *_Setting) LoadFile(filename string) error {
 
 		ss := strings.SplitN(line, "=", 2)
 		if len(ss) != 2 {
-			return xerr.Errorf("setting: invalid key=value pairs in %s:%d", filename, lineno)
+			return nil, nil, xerr.Errorf("setting: invalid key=value pairs in %s:%d", filename, lineno)
 		}
 
 		key, value := ss[0], ss[1]
 		key = strings.TrimSpace(key)
 		value = strings.TrimSpace(value)
 		if len(key) == 0 || len(value) == 0 {
-			return xerr.Errorf("setting: invalid key=value pairs in %s:%d", filename, lineno)
+			return nil, nil, xerr.Errorf("setting: invalid key=value pairs in %s:%d", filename, lineno)
 		}
 
+		items[key] = value
+	}
+	return items, fi, nil
+}
+
+func (st *_Setting) LoadFile(filename string) error {
+	filename = filepath.Clean(filename)
+	items, fi, err := readSettingFile(filename)
+	if err != nil {
+		return err
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for key, value := range items {
 		st.m.Store(key, value)
 	}
 	st.filename = filename
+	st.mtime = fi.ModTime()
+	st.size = fi.Size()
+	st.fileItems = items
 	return nil
 }
 
+/*
+   Reload the file loaded by LoadFile() and return the names of the changed
+   items. The file is not read again if its mtime and size are unchanged.
+   The items set by Set(), Remove() or Insert() win over the file,
+   they are not changed by Reload() even if the file adds, changes or
+   removes them later. The watchers are called if anything changed.
+*/
+func (st *_Setting) Reload() ([]string, error) {
+	st.mutex.Lock()
+	if st.filename == "" {
+		st.mutex.Unlock()
+		return nil, nil
+	}
+
+	if fi, err := os.Stat(st.filename); err == nil && fi.ModTime().Equal(st.mtime) && fi.Size() == st.size {
+		st.mutex.Unlock()
+		return nil, nil
+	}
+
+	items, fi, err := readSettingFile(st.filename)
+	if err != nil {
+		st.mutex.Unlock()
+		return nil, err
+	}
+	st.mtime = fi.ModTime()
+	st.size = fi.Size()
+
+	var changed []string
+	for key := range st.fileItems {
+		if _, ok := items[key]; !ok && !st.explicit[key] {
+			st.m.Delete(key)
+			changed = append(changed, key)
+		}
+	}
+	for key, value := range items {
+		old, ok := st.fileItems[key]
+		if (ok && value == old) || st.explicit[key] {
+			continue
+		}
+		st.m.Store(key, value)
+		changed = append(changed, key)
+	}
+	st.fileItems = items
+	watchers := st.watchers
+	st.mutex.Unlock()
+
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		for _, fn := range watchers {
+			fn(st, changed)
+		}
+	}
+	return changed, nil
+}
+
+func (st *_Setting) Watch(fn SettingWatcher) {
+	st.mutex.Lock()
+	st.watchers = append(st.watchers, fn)
+	st.mutex.Unlock()
+}
+
+// Called with st.mutex locked
+func (st *_Setting) _set_explicit(name string) {
+	if st.explicit == nil {
+		st.explicit = make(map[string]bool)
+	}
+	st.explicit[name] = true
+}
+
 func (st *_Setting) Set(name string, value string) {
+	st.mutex.Lock()
+	st._set_explicit(name)
 	st.m.Store(name, value)
+	st.mutex.Unlock()
 }
 
 func (st *_Setting) Remove(name string) {
+	st.mutex.Lock()
+	st._set_explicit(name)
 	st.m.Delete(name)
+	st.mutex.Unlock()
 }
 
 func (st *_Setting) Insert(name string, value string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
 	_, loaded := st.m.LoadOrStore(name, value)
+	if !loaded {
+		st._set_explicit(name)
+	}
 	return !loaded
 }
 
@@ -3,6 +3,9 @@ package xic
 import (
 	"testing"
 	"fmt"
+	"os"
+	"io/ioutil"
+	"time"
 )
 
 func TestSettingPathname(t *testing.T) {
@@ -16,3 +19,59 @@ func TestSettingPathname(t *testing.T) {
 	}
 }
 
+
+func TestSettingReload(t *testing.T) {
+	fp, err := ioutil.TempFile("", "setting.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := fp.Name()
+	defer os.Remove(filename)
+	fp.WriteString("A = 1\nB = 2\nC = 3\n")
+	fp.Close()
+
+	setting, err := NewSettingFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := setting.(ReloadableSetting)
+
+	var notified []string
+	st.Watch(func(st Setting, changed []string) {
+		notified = changed
+	})
+
+	st.Set("C", "30")
+	st.Set("E", "50")
+	ioutil.WriteFile(filename, []byte("A = 1\nB = 22\nC = 33\nD = 4\nE = 5\n"), 0644)
+
+	changed, err := st.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(changed) != "[B D]" || fmt.Sprint(notified) != "[B D]" {
+		t.Errorf("setting.Reload() changed %v, notified %v", changed, notified)
+	}
+	if st.Get("B") != "22" || st.Get("C") != "30" || st.Get("D") != "4" || st.Get("E") != "50" {
+		t.Errorf("setting.Reload() failed, B=%s C=%s D=%s E=%s", st.Get("B"), st.Get("C"), st.Get("D"), st.Get("E"))
+	}
+
+	ioutil.WriteFile(filename, []byte("A = 1\n"), 0644)
+	changed, _ = st.Reload()
+	if fmt.Sprint(changed) != "[B D]" || st.Has("B") || !st.Has("C") || !st.Has("E") {
+		t.Errorf("setting.Reload() failed to remove items, changed %v", changed)
+	}
+
+	// Not read again if the mtime and size unchanged
+	fi, _ := os.Stat(filename)
+	ioutil.WriteFile(filename, []byte("A = 2\n"), 0644)
+	os.Chtimes(filename, fi.ModTime(), fi.ModTime())
+	if changed, _ = st.Reload(); len(changed) != 0 || st.Get("A") != "1" {
+		t.Errorf("setting.Reload() should skip the file unchanged, changed %v", changed)
+	}
+	mtime := fi.ModTime().Add(time.Second)
+	os.Chtimes(filename, mtime, mtime)
+	if changed, _ = st.Reload(); fmt.Sprint(changed) != "[A]" || st.Get("A") != "2" {
+		t.Errorf("setting.Reload() failed after the mtime changed, changed %v", changed)
+	}
+}
@@ -8,5 +8,6 @@ import (
 
 func install_additional_signals(engine *_Engine) {
 	signal.Notify(engine.sigChan, syscall.SIGTERM)
+	signal.Notify(engine.hupChan, syscall.SIGHUP)
 }
 
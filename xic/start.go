@@ -10,6 +10,7 @@ import (
 )
 
 func parseArgs() (file string, cfs map[string]string, args []string) {
+	cfs = make(map[string]string)
 	args = append(args, os.Args[0])
 	i := 1
 	for ; i < len(os.Args); i++ {
@@ -34,7 +35,7 @@ func parseArgs() (file string, cfs map[string]string, args []string) {
 				eq := strings.IndexByte(s[dot+1:], '=')
 				if eq > 0 {
 					eq += dot + 1
-					key := s[:eq]
+					key := s[2:eq]
 					value := s[eq+1:]
 					cfs[key] = value
 					continue
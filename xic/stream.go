@@ -0,0 +1,184 @@
+package xic
+
+import (
+	"reflect"
+
+	"halftwo/mangos/dlog"
+)
+
+/*
+   A streaming method sends partial answers (status 1) before the final
+   answer (status 0 or -1) of the same txid. The client specifies in the
+   context XIC_STREAM the number of partial answers it can buffer, and
+   sends CREDIT check messages after consuming the partial answers.
+   The server stops sending when the credit is used up, so neither the
+   OutMsgQueue of the server nor the buffer of the client can grow
+   without bound.
+*/
+
+const DEFAULT_STREAM_WINDOW = 16
+
+const (
+	answer_EXCEPTION = -1
+	answer_NORMAL = 0
+	answer_PARTIAL = 1
+)
+
+const ck_CREDIT = "CREDIT"
+
+type _CreditArgs struct {
+	Txid int64	`vbs:"txid"`
+	Num int		`vbs:"num"`
+}
+
+var typeOfStream = reflect.TypeOf((*Stream)(nil)).Elem()
+
+type _ServerStream struct {
+	con *_Connection
+	txid int64
+	high bool
+	credit int	// protected by con.mutex
+	canceled bool	// protected by con.mutex
+}
+
+var _ Stream = (*_ServerStream)(nil)
+
+func (con *_Connection) newServerStream(quest *_InQuest) (*_ServerStream, error) {
+	window := quest.ctx.GetInt("XIC_STREAM", 0)
+	if window <= 0 {
+		return nil, newExf(InvalidParameterException, "Streaming method %#v invoked without XIC_STREAM in context", quest.method)
+	}
+
+	st := &_ServerStream{con:con, txid:quest.txid, high:quest.high, credit:int(window)}
+	con.mutex.Lock()
+	if con.streams == nil {
+		con.streams = make(map[int64]*_ServerStream)
+	}
+	con.streams[st.txid] = st
+	con.mutex.Unlock()
+	return st, nil
+}
+
+func (con *_Connection) endServerStream(st *_ServerStream) {
+	con.mutex.Lock()
+	delete(con.streams, st.txid)
+	con.mutex.Unlock()
+}
+
+func (con *_Connection) addStreamCredit(txid int64, num int) {
+	con.mutex.Lock()
+	if st, ok := con.streams[txid]; ok {
+		st.credit += num
+		con.cond.Broadcast()
+	}
+	con.mutex.Unlock()
+}
+
+// The servant goroutine can't panic, so out is checked without assertion
+func (st *_ServerStream) Send(out any) error {
+	if out != nil && !IsValidInType(reflect.TypeOf(out)) {
+		return newExf(InvalidParameterException, "Partial answer must be a (pointer to) map[string]* or a (pointer to) struct, not %T", out)
+	}
+	con := st.con
+	con.mutex.Lock()
+	for st.credit <= 0 && !st.canceled && con.state <= con_CLOSING {
+		con.cond.Wait()
+	}
+	canceled := st.canceled
+	ok := !canceled && con.state <= con_CLOSING
+	if ok {
+		st.credit--
+	}
+	con.mutex.Unlock()
+
+	if canceled {
+		return newException(QuestCanceledException)
+	} else if !ok {
+		return newException(ConnectionClosedException)
+	}
+	answer := newOutAnswerPartial(st.txid, out)
+	answer.high = st.high
+	con.sendMessage(answer)
+	return nil
+}
+
+// The partial answers received, protected by the mutex of _Result
+type _ClientStream struct {
+	con *_Connection
+	window int
+	partials []*_InAnswer
+	consumed int
+	err error
+}
+
+func (r *_Result) pushPartial(answer *_InAnswer) {
+	st := r.stream
+	r.cond.L.Lock()
+	failed := st.err != nil
+	if !failed {
+		st.partials = append(st.partials, answer)
+		r.cond.Broadcast()
+	}
+	r.cond.L.Unlock()
+
+	if failed {
+		// Discard it and let the server go on
+		st.con.sendMessage(newOutCheck(ck_CREDIT, &_CreditArgs{Txid:r.txid, Num:1}))
+	}
+}
+
+func (r *_Result) Next(out any) bool {
+	st := r.stream
+	if st == nil {
+		return false
+	}
+
+	r.cond.L.Lock()
+	for len(st.partials) == 0 && st.err == nil && !r.done.Load() {
+		r.cond.Wait()
+	}
+	if len(st.partials) == 0 || st.err != nil {
+		r.cond.L.Unlock()
+		return false
+	}
+	answer := st.partials[0]
+	st.partials[0] = nil
+	st.partials = st.partials[1:]
+
+	credit := 0
+	st.consumed++
+	if st.consumed >= (st.window + 1) / 2 {
+		credit = st.consumed
+		st.consumed = 0
+	}
+	if out != nil {
+		if err := answer.DecodeArgs(out); err != nil {
+			st.err = err
+			credit += len(st.partials)
+			st.partials = nil
+		}
+	}
+	ok := st.err == nil
+	r.cond.L.Unlock()
+
+	if credit > 0 && !r.done.Load() {
+		st.con.sendMessage(newOutCheck(ck_CREDIT, &_CreditArgs{Txid:r.txid, Num:credit}))
+	}
+	if !ok {
+		dlog.Log("XIC.WARN", "Failed to decode partial answer of %s::%s, txid=%d --- %s", r.service, r.method, r.txid, st.err.Error())
+	}
+	return ok
+}
+
+func (prx *_Proxy) InvokeStream(ctx Context, method string, in any) StreamResult {
+	// Copied so that the XIC_STREAM is not added to the ctx of the caller
+	qctx := NewContext()
+	qctx.Extend(ctx)
+	window := qctx.GetInt("XIC_STREAM", 0)
+	if window <= 0 {
+		window = DEFAULT_STREAM_WINDOW
+		qctx["XIC_STREAM"] = window
+	}
+	stream := &_ClientStream{window:int(window)}
+	return prx.invoke_async(qctx, method, in, nil, nil, stream)
+}
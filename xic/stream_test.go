@@ -0,0 +1,89 @@
+package xic
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type _StreamServant struct {
+	DefaultServant
+	sent atomic.Int32
+	invalid chan error	// the error of sending an invalid partial answer
+}
+
+type _ListArgs struct {
+	Count int	`vbs:"count"`
+	Fail bool	`vbs:"fail"`
+}
+
+type _ItemArgs struct {
+	N int		`vbs:"n"`
+}
+
+func (s *_StreamServant) Xic_list(cur Current, in _ListArgs, stream Stream) error {
+	s.invalid <- stream.Send(in.Count)
+	for i := 0; i < in.Count; i++ {
+		if err := stream.Send(_ItemArgs{N:i}); err != nil {
+			return err
+		}
+		s.sent.Add(1)
+	}
+	if in.Fail {
+		return newEx(InvalidParameterException, "list failed")
+	}
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	srv, cli, adapter, endpoint := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv, cli)
+	servant := &_StreamServant{invalid:make(chan error, 2)}
+	adapter.MustAddServant("Stream", servant)
+	prx, _ := cli.StringToProxy("Stream" + endpoint)
+
+	res := prx.InvokeStream(Context{"XIC_STREAM":int64(2)}, "list", _ListArgs{Count:10})
+	if ex, ok := (<-servant.invalid).(Exception); !ok || ex.Name() != InvalidParameterException {
+		t.Errorf("Sending an invalid partial answer should fail")
+	}
+
+	// The servant is blocked after the credit used up
+	for i := 0; i < 100 && servant.sent.Load() < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := servant.sent.Load(); n != 2 {
+		t.Fatalf("%d partial answers sent with the credit 2", n)
+	}
+
+	var item _ItemArgs
+	for i := 0; i < 10; i++ {
+		if !res.Next(&item) {
+			t.Fatalf("Next() failed at %d: %v", i, res.Err())
+		}
+		if item.N != i {
+			t.Fatalf("Next() got %d, should be %d", item.N, i)
+		}
+	}
+	if res.Next(&item) {
+		t.Fatalf("Next() should return false after the end of the stream")
+	}
+	if !res.Done() || res.Err() != nil {
+		t.Errorf("Stream not ended normally: %v", res.Err())
+	}
+
+	// The stream ended with an exception
+	ctx := Context{"trace":"stream"}
+	res = prx.InvokeStream(ctx, "list", _ListArgs{Count:3, Fail:true})
+	if len(ctx) != 1 {
+		t.Errorf("InvokeStream() changed the ctx of the caller: %v", ctx)
+	}
+	<-servant.invalid
+	n := 0
+	for res.Next(&item) {
+		n++
+	}
+	if n != 3 || res.Err() == nil {
+		t.Errorf("Stream with exception got %d partial answers, err=%v", n, res.Err())
+	}
+}
@@ -0,0 +1,262 @@
+package xic
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"halftwo/mangos/dlog"
+)
+
+/*
+   The trace context is carried in the Context of the quests:
+	XIC_TRACE	the trace id, 32 hex digits
+	XIC_SPAN	the span id of the caller, 16 hex digits
+	XIC_SAMPLED	whether the spans of the trace are exported
+
+   If the Context of an invoke has no XIC_TRACE and a SpanExporter is set
+   (see Engine.SetSpanExporter() and xic.trace.exporter), a new trace is
+   started and sampled with the probability xic.trace.sample. Otherwise
+   the trace in the Context is continued with a new client span.
+
+   The server records a server span for each traced quest, and replaces
+   the XIC_SPAN in Current.Ctx() with the id of the server span. The trace
+   is not propagated into the nested calls made by the servant unless they
+   carry the trace context, i.e. made with Current.Ctx() or
+   Current.TraceContext(), or through the proxy returned by
+   Current.TracedProxy().
+*/
+
+type SpanKind int
+
+const (
+	SPAN_CLIENT SpanKind = iota
+	SPAN_SERVER
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SPAN_CLIENT:
+		return "client"
+	case SPAN_SERVER:
+		return "server"
+	}
+	return "unknown"
+}
+
+type Span struct {
+	TraceId  string
+	SpanId   string
+	ParentId string		// empty for the root span
+	Kind     SpanKind
+	Service  string
+	Method   string
+	Peer     string		// the endpoint of the client span, or the remote address of the server span
+	Start    time.Time
+	Duration time.Duration
+	Error    string		// empty if succeeded
+}
+
+/*
+   SpanExporter records the finished spans of the sampled traces.
+   Export() is called in the goroutine finishing the invoke or the quest,
+   so it should not block. The span should be copied if kept.
+*/
+type SpanExporter interface {
+	Export(span *Span)
+}
+
+type _DlogSpanExporter struct{}
+
+// The spans are logged with the tag XIC.TRACE
+func NewDlogSpanExporter() SpanExporter {
+	return _DlogSpanExporter{}
+}
+
+func (_DlogSpanExporter) Export(span *Span) {
+	dlog.Log("XIC.TRACE", "trace=%s span=%s parent=%s kind=%s %s::%s peer=%s duration=%d error=%s",
+		span.TraceId, span.SpanId, span.ParentId, span.Kind, span.Service, span.Method,
+		span.Peer, span.Duration / time.Microsecond, span.Error)
+}
+
+// MemorySpanExporter keeps the spans in memory, mostly for tests.
+type MemorySpanExporter struct {
+	mutex sync.Mutex
+	spans []Span
+}
+
+func NewMemorySpanExporter() *MemorySpanExporter {
+	return &MemorySpanExporter{}
+}
+
+func (m *MemorySpanExporter) Export(span *Span) {
+	m.mutex.Lock()
+	m.spans = append(m.spans, *span)
+	m.mutex.Unlock()
+}
+
+// Return the exported spans in the order of finishing
+func (m *MemorySpanExporter) Spans() []Span {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Span(nil), m.spans...)
+}
+
+func (m *MemorySpanExporter) Reset() {
+	m.mutex.Lock()
+	m.spans = nil
+	m.mutex.Unlock()
+}
+
+type _Tracer struct {
+	exporter SpanExporter
+	sample float64
+}
+
+func newTraceId() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+func newSpanId() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+type _ActiveSpan struct {
+	Span
+	exporter SpanExporter	// nil if the trace is not sampled
+}
+
+func (s *_ActiveSpan) finish(err error) {
+	if s == nil || s.exporter == nil {
+		return
+	}
+	s.Duration = time.Since(s.Start)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.exporter.Export(&s.Span)
+}
+
+// Return a new Context with the trace context of the client span,
+// or ctx itself if the invoke is not traced.
+func (engine *_Engine) startClientSpan(ctx Context, service, method string) (Context, *_ActiveSpan) {
+	tracer := engine.tracer.Load()
+	traceId := ctx.GetString("XIC_TRACE", "")
+	parent := ""
+	sampled := false
+	if traceId == "" {
+		if tracer == nil {
+			return ctx, nil
+		}
+		traceId = newTraceId()
+		sampled = tracer.sample >= 1.0 || rand.Float64() < tracer.sample
+	} else {
+		parent = ctx.GetString("XIC_SPAN", "")
+		sampled = ctx.GetBool("XIC_SAMPLED", false)
+	}
+
+	span := &_ActiveSpan{Span: Span{TraceId:traceId, SpanId:newSpanId(), ParentId:parent,
+			Kind:SPAN_CLIENT, Service:service, Method:method, Start:time.Now()}}
+	if sampled && tracer != nil {
+		span.exporter = tracer.exporter
+	}
+
+	// ctx may be shared, e.g. the Context of the proxy
+	c := make(Context, len(ctx) + 3)
+	for k, v := range ctx {
+		c[k] = v
+	}
+	c["XIC_TRACE"] = traceId
+	c["XIC_SPAN"] = span.SpanId
+	c["XIC_SAMPLED"] = sampled
+	return c, span
+}
+
+// The proxy adding the trace context of a quest to the Context of the
+// invokes, see Current.TracedProxy()
+type _TracedProxy struct {
+	Proxy
+	trace Context
+}
+
+// Return a new Context with the trace context added, ctx is not changed
+func (tp *_TracedProxy) context(ctx Context) Context {
+	c := make(Context, len(ctx) + len(tp.trace))
+	for k, v := range ctx {
+		c[k] = v
+	}
+	c.Extend(tp.trace)
+	return c
+}
+
+func (tp *_TracedProxy) Invoke(method string, in, out any) error {
+	return tp.Proxy.InvokeCtx(tp.context(nil), method, in, out)
+}
+
+func (tp *_TracedProxy) InvokeCtx(ctx Context, method string, in, out any) error {
+	return tp.Proxy.InvokeCtx(tp.context(ctx), method, in, out)
+}
+
+func (tp *_TracedProxy) InvokeAsync(method string, in, out any) Result {
+	return tp.Proxy.InvokeCtxAsync(tp.context(nil), method, in, out)
+}
+
+func (tp *_TracedProxy) InvokeCtxAsync(ctx Context, method string, in, out any) Result {
+	return tp.Proxy.InvokeCtxAsync(tp.context(ctx), method, in, out)
+}
+
+func (tp *_TracedProxy) InvokeAsyncCallback(method string, in, out any, callback func(Result)) Result {
+	return tp.Proxy.InvokeCtxAsyncCallback(tp.context(nil), method, in, out, callback)
+}
+
+func (tp *_TracedProxy) InvokeCtxAsyncCallback(ctx Context, method string, in, out any, callback func(Result)) Result {
+	return tp.Proxy.InvokeCtxAsyncCallback(tp.context(ctx), method, in, out, callback)
+}
+
+func (tp *_TracedProxy) InvokeOneway(method string, in any) error {
+	return tp.Proxy.InvokeCtxOneway(tp.context(nil), method, in)
+}
+
+func (tp *_TracedProxy) InvokeCtxOneway(ctx Context, method string, in any) error {
+	return tp.Proxy.InvokeCtxOneway(tp.context(ctx), method, in)
+}
+
+func (tp *_TracedProxy) InvokeAll(ctx Context, method string, in any, outFactory func() any) []Result {
+	return tp.Proxy.InvokeAll(tp.context(ctx), method, in, outFactory)
+}
+
+func (tp *_TracedProxy) InvokeAllOneway(ctx Context, method string, in any) []Result {
+	return tp.Proxy.InvokeAllOneway(tp.context(ctx), method, in)
+}
+
+func (tp *_TracedProxy) InvokeStream(ctx Context, method string, in any) StreamResult {
+	return tp.Proxy.InvokeStream(tp.context(ctx), method, in)
+}
+
+func (tp *_TracedProxy) InvokeBatch(calls []BatchCall) []Result {
+	traced := make([]BatchCall, len(calls))
+	for i, c := range calls {
+		traced[i] = c
+		traced[i].Ctx = tp.context(c.Ctx)
+	}
+	return tp.Proxy.InvokeBatch(traced)
+}
+
+// Return nil if the quest is not traced
+func (con *_Connection) startServerSpan(quest *_InQuest) *_ActiveSpan {
+	traceId := quest.ctx.GetString("XIC_TRACE", "")
+	if traceId == "" {
+		return nil
+	}
+
+	span := &_ActiveSpan{Span: Span{TraceId:traceId, SpanId:newSpanId(), ParentId:quest.ctx.GetString("XIC_SPAN", ""),
+			Kind:SPAN_SERVER, Service:quest.service, Method:quest.method, Peer:con.remoteAddr(), Start:time.Now()}}
+	if quest.ctx.GetBool("XIC_SAMPLED", false) {
+		if tracer := con.engine.tracer.Load(); tracer != nil {
+			span.exporter = tracer.exporter
+		}
+	}
+	quest.ctx["XIC_SPAN"] = span.SpanId
+	return span
+}
@@ -0,0 +1,114 @@
+package xic
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTracePropagation(t *testing.T) {
+	setting := NewSetting()
+	setting.Set("xic.trace.sample", "1")
+	engine := newEngineSetting(setting)
+	exp := NewMemorySpanExporter()
+	engine.SetSpanExporter(exp)
+
+	ctx := Context{"a":"b"}
+	qctx, cspan := engine.startClientSpan(ctx, "Demo", "echo")
+	if cspan == nil || len(cspan.TraceId) != 32 || len(cspan.SpanId) != 16 || cspan.ParentId != "" {
+		t.Fatalf("Bug in startClientSpan() %v", cspan)
+	}
+	if ctx.Has("XIC_TRACE") || qctx.GetString("a", "") != "b" || qctx.GetString("XIC_SPAN", "") != cspan.SpanId {
+		t.Fatalf("Wrong trace context %v", qctx)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	con := _newConnection(engine, true)
+	con.c = c1
+
+	quest := &_InQuest{service:"Demo", method:"echo", ctx:qctx}
+	sspan := con.startServerSpan(quest)
+	if sspan == nil || sspan.TraceId != cspan.TraceId || sspan.ParentId != cspan.SpanId {
+		t.Fatalf("Bug in startServerSpan() %v", sspan)
+	}
+
+	// The nested call from the servant
+	cur := newCurrent(con, quest)
+	_, nspan := engine.startClientSpan(cur.TraceContext(), "Other", "call")
+	if nspan.TraceId != cspan.TraceId || nspan.ParentId != sspan.SpanId {
+		t.Fatalf("Trace not propagated to nested call %v", nspan)
+	}
+
+	nspan.finish(nil)
+	sspan.finish(newException(MethodNotFoundException))
+	cspan.finish(nil)
+	spans := exp.Spans()
+	if len(spans) != 3 || spans[1].Kind != SPAN_SERVER || spans[1].Error == "" || spans[2].Kind != SPAN_CLIENT {
+		t.Fatalf("Wrong exported spans %v", spans)
+	}
+
+	// Not sampled
+	exp.Reset()
+	qctx["XIC_SAMPLED"] = false
+	_, span := engine.startClientSpan(qctx, "Demo", "echo")
+	span.finish(nil)
+	if len(exp.Spans()) != 0 {
+		t.Fatalf("Span of the trace not sampled exported")
+	}
+
+	// No exporter, no new trace
+	engine.SetSpanExporter(nil)
+	if c, span := engine.startClientSpan(ctx, "Demo", "echo"); span != nil || c.Has("XIC_TRACE") {
+		t.Fatalf("New trace started without exporter")
+	}
+}
+
+type _TraceServant struct {
+	DefaultServant
+	prx Proxy
+}
+
+func (s *_TraceServant) Xic_call(cur Current, in struct{}, out *_BenchArgs) error {
+	return cur.TracedProxy(s.prx).Invoke("echo", _BenchArgs{Seq:1}, out)
+}
+
+func TestTracedProxy(t *testing.T) {
+	srv, cli, adapter, endpoint := startTestEngines(t, false, nil, nil)
+	defer stopTestEngines(srv, cli)
+	exp := NewMemorySpanExporter()
+	srv.SetSpanExporter(exp)
+	cli.SetSpanExporter(exp)
+
+	bench, _ := srv.StringToProxy("Bench" + endpoint)
+	adapter.MustAddServant("Trace", &_TraceServant{prx:bench})
+	prx, _ := cli.StringToProxy("Trace" + endpoint)
+	var out _BenchArgs
+	if err := prx.Invoke("call", struct{}{}, &out); err != nil || out.Seq != 1 {
+		t.Fatalf("Invoke failed: %v", err)
+	}
+
+	// The client span is exported after the answer received
+	var spans []Span
+	for i := 0; i < 100; i++ {
+		if spans = exp.Spans(); len(spans) == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(spans) != 4 {
+		t.Fatalf("%d spans exported, should be 4", len(spans))
+	}
+	byKind := make(map[string]Span)
+	for _, s := range spans {
+		if s.TraceId != spans[0].TraceId {
+			t.Fatalf("Trace not propagated into the nested call %v", spans)
+		}
+		byKind[s.Service + " " + s.Kind.String()] = s
+	}
+	if byKind["Bench client"].ParentId != byKind["Trace server"].SpanId ||
+			byKind["Bench server"].ParentId != byKind["Bench client"].SpanId {
+		t.Errorf("Wrong parent of the nested spans %v", spans)
+	}
+}